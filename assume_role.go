@@ -0,0 +1,74 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// assumedRoleRecorder is an STS client recording the ARN of the role assumed
+// by the last successful AssumeRole call.
+type assumedRoleRecorder struct {
+	*sts.STS
+	logger *slog.Logger
+
+	mtx sync.Mutex
+	arn string
+}
+
+func (r *assumedRoleRecorder) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	return r.AssumeRoleWithContext(aws.BackgroundContext(), input)
+}
+
+func (r *assumedRoleRecorder) AssumeRoleWithContext(ctx aws.Context, input *sts.AssumeRoleInput, opts ...request.Option) (*sts.AssumeRoleOutput, error) {
+	out, err := r.STS.AssumeRoleWithContext(ctx, input, opts...)
+	if err != nil || out.AssumedRoleUser == nil {
+		return out, err
+	}
+
+	arn := aws.StringValue(out.AssumedRoleUser.Arn)
+	r.mtx.Lock()
+	changed := arn != r.arn
+	r.arn = arn
+	r.mtx.Unlock()
+
+	if changed && r.logger != nil {
+		r.logger.Info("Assumed role for SigV4 signing", "arn", arn)
+	}
+	return out, nil
+}
+
+// ARN returns the ARN of the last assumed role.
+func (r *assumedRoleRecorder) ARN() string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.arn
+}
+
+// AssumedRoleARN returns the ARN of the role that rt, as returned by
+// NewSigV4RoundTripper, last assumed to sign requests. It is empty if rt
+// doesn't assume a role or hasn't done so yet.
+func AssumedRoleARN(rt http.RoundTripper) string {
+	srt, ok := rt.(*sigV4RoundTripper)
+	if !ok || srt.assumedRole == nil {
+		return ""
+	}
+	return srt.assumedRole.ARN()
+}
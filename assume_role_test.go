@@ -0,0 +1,304 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssumedRoleARN(t *testing.T) {
+	const roleARN = "arn:aws:iam::123456789012:role/target"
+
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	fakeSTS(t)
+
+	var buf bytes.Buffer
+	next := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	rt, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:    "us-east-2",
+		AccessKey: "test-id",
+		SecretKey: "secret",
+		RoleARN:   roleARN,
+	}, next, WithLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+	require.NoError(t, err)
+	require.Empty(t, AssumedRoleARN(rt))
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Equal(t, roleARN, AssumedRoleARN(rt))
+	require.Contains(t, buf.String(), `msg="Assumed role for SigV4 signing" arn=`+roleARN)
+
+	// Round trippers that don't assume a role report no ARN.
+	rt, err = NewSigV4RoundTripper(&SigV4Config{Region: "us-east-2", AccessKey: "test-id", SecretKey: "secret"}, next)
+	require.NoError(t, err)
+	require.Empty(t, AssumedRoleARN(rt))
+	require.Empty(t, AssumedRoleARN(http.DefaultTransport))
+}
+
+func TestNewSigV4RoundTripper_AssumeRoleRegion(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	stsCalls := fakeSTS(t)
+
+	var gotReq *http.Request
+	rt, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:           "us-east-2",
+		AccessKey:        "test-id",
+		SecretKey:        "secret",
+		RoleARN:          "arn:aws:iam::123456789012:role/target",
+		AssumeRoleRegion: "eu-west-1",
+	}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	// STS is called in the pinned region, while requests are still signed
+	// for the configured one.
+	require.Len(t, *stsCalls, 1)
+	require.Contains(t, (*stsCalls)[0].Get("Authorization"), "/eu-west-1/sts/aws4_request")
+	require.Contains(t, gotReq.Header.Get("Authorization"), "/us-east-2/aps/aws4_request")
+}
+
+func TestNewSigV4RoundTripper_CredentialsRefreshWindow(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	fakeSTS(t)
+
+	next := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	expiresAt := func(window time.Duration) time.Time {
+		rt, err := newSigV4RoundTripperFromConfig(context.Background(), &SigV4Config{
+			Region:                   "us-east-2",
+			AccessKey:                "test-id",
+			SecretKey:                "secret",
+			RoleARN:                  "arn:aws:iam::123456789012:role/target",
+			CredentialsRefreshWindow: model.Duration(window),
+		}, next)
+		require.NoError(t, err)
+		_, err = rt.creds.Get()
+		require.NoError(t, err)
+		exp, err := rt.creds.ExpiresAt()
+		require.NoError(t, err)
+		return exp
+	}
+
+	// The fake STS hands out credentials expiring at the start of 2099.
+	expiration := time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, expiration, expiresAt(0).UTC())
+	require.Equal(t, expiration.Add(-time.Minute), expiresAt(time.Minute).UTC())
+}
+
+func TestNewSigV4RoundTripper_CredentialsHTTPClient(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	stsCalls := fakeSTS(t)
+
+	sts := http.DefaultClient.Transport
+	var clientCalls, nextCalls int
+	client := &http.Client{Transport: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		clientCalls++
+		return sts.RoundTrip(req)
+	})}
+	rt, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:    "us-east-2",
+		AccessKey: "test-id",
+		SecretKey: "secret",
+		RoleARN:   "arn:aws:iam::123456789012:role/target",
+	}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		nextCalls++
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}), WithCredentialsHTTPClient(client))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	// The role was assumed through the client, and only the signed request
+	// went to next.
+	require.Len(t, *stsCalls, 1)
+	require.Equal(t, 1, clientCalls)
+	require.Equal(t, 1, nextCalls)
+}
+
+func TestNewSigV4RoundTripper_RoleSession(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	stsCalls := fakeSTS(t)
+
+	rt, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:          "us-east-2",
+		AccessKey:       "test-id",
+		SecretKey:       "secret",
+		RoleARN:         "arn:aws:iam::123456789012:role/target",
+		RoleSessionName: "prometheus",
+		SessionDuration: model.Duration(30 * time.Minute),
+	}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Len(t, *stsCalls, 1)
+	require.Equal(t, "prometheus", (*stsCalls)[0].Get("RoleSessionName"))
+	require.Equal(t, "1800", (*stsCalls)[0].Get("DurationSeconds"))
+}
+
+func TestNewSigV4RoundTripper_MFA(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	stsCalls := fakeSTS(t)
+
+	rt, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:    "us-east-2",
+		AccessKey: "test-id",
+		SecretKey: "secret",
+		RoleARN:   "arn:aws:iam::123456789012:role/target",
+		MFASerial: "arn:aws:iam::123456789012:mfa/user",
+	}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}), WithMFATokenProvider(func() (string, error) { return "123456", nil }))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Len(t, *stsCalls, 1)
+	require.Equal(t, "arn:aws:iam::123456789012:mfa/user", (*stsCalls)[0].Get("SerialNumber"))
+	require.Equal(t, "123456", (*stsCalls)[0].Get("TokenCode"))
+
+	// Without a token provider, roles requiring MFA could never be assumed.
+	cfg := &SigV4Config{
+		Region:    "us-east-2",
+		AccessKey: "test-id",
+		SecretKey: "secret",
+		RoleARN:   "arn:aws:iam::123456789012:role/target",
+		MFASerial: "arn:aws:iam::123456789012:mfa/user",
+	}
+	_, err = NewSigV4RoundTripper(cfg, nil)
+	require.ErrorContains(t, err, "mfa_serial requires an MFA token provider")
+	_, err = CredentialsProvider(context.Background(), cfg)
+	require.ErrorContains(t, err, "mfa_serial requires an MFA token provider")
+	require.Len(t, *stsCalls, 1)
+}
+
+func TestNewSigV4RoundTripper_WebIdentity(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	stsCalls := fakeSTS(t)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("web-identity-token"), 0o600))
+	cfg := &SigV4Config{
+		Region:               "us-east-2",
+		RoleARN:              "arn:aws:iam::123456789012:role/target",
+		RoleSessionName:      "prometheus",
+		WebIdentityTokenFile: tokenFile,
+	}
+
+	creds, err := CredentialsProvider(context.Background(), cfg)
+	require.NoError(t, err)
+	value, err := creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, stscreds.WebIdentityProviderName, value.ProviderName)
+
+	var gotReq *http.Request
+	rt, err := NewSigV4RoundTripper(cfg, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Contains(t, gotReq.Header.Get("Authorization"), "Credential=ASIA2/")
+
+	require.Len(t, *stsCalls, 2)
+	for _, call := range *stsCalls {
+		require.Equal(t, "AssumeRoleWithWebIdentity", call.Get("Action"))
+		require.Equal(t, "web-identity-token", call.Get("WebIdentityToken"))
+		require.Equal(t, "prometheus", call.Get("RoleSessionName"))
+		// The token authenticates the call rather than a signature.
+		require.Empty(t, call.Get("Authorization"))
+	}
+}
+
+func TestNewSigV4RoundTripper_RoleARNChain(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	stsCalls := fakeSTS(t)
+
+	var gotReq *http.Request
+	rt, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:    "us-east-2",
+		AccessKey: "test-id",
+		SecretKey: "secret",
+		RoleARNChain: []string{
+			"arn:aws:iam::123456789012:role/landing",
+			"arn:aws:iam::210987654321:role/target",
+		},
+		RoleSessionName: "prometheus",
+		MFASerial:       "arn:aws:iam::123456789012:mfa/user",
+	}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}), WithMFATokenProvider(func() (string, error) { return "123456", nil }))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	// Each role is assumed with the credentials of the previous one, and
+	// requests are signed with those of the last.
+	require.Len(t, *stsCalls, 2)
+	landing, target := (*stsCalls)[0], (*stsCalls)[1]
+	require.Equal(t, "arn:aws:iam::123456789012:role/landing", landing.Get("RoleArn"))
+	require.Contains(t, landing.Get("Authorization"), "Credential=test-id/")
+	require.Equal(t, "123456", landing.Get("TokenCode"))
+	require.Equal(t, "arn:aws:iam::210987654321:role/target", target.Get("RoleArn"))
+	require.Contains(t, target.Get("Authorization"), "Credential=ASIA1/")
+	require.Empty(t, target.Get("TokenCode"))
+	for _, call := range *stsCalls {
+		require.Equal(t, "prometheus", call.Get("RoleSessionName"))
+	}
+	require.Contains(t, gotReq.Header.Get("Authorization"), "Credential=ASIA2/")
+	require.Equal(t, "arn:aws:iam::210987654321:role/target", AssumedRoleARN(rt))
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+type (
+	credentialsContextKey  struct{}
+	metricLabelsContextKey struct{}
+)
+
+// ContextWithCredentials returns a copy of ctx carrying creds. Requests sent
+// with the returned context are signed with creds instead of the configured
+// credentials. If a role is configured, creds are used to assume it and the
+// request is signed with the role credentials.
+func ContextWithCredentials(ctx context.Context, creds credentials.Value) context.Context {
+	return context.WithValue(ctx, credentialsContextKey{}, creds)
+}
+
+// credentialsFromContext returns the credentials set by ContextWithCredentials.
+func credentialsFromContext(ctx context.Context) (credentials.Value, bool) {
+	creds, ok := ctx.Value(credentialsContextKey{}).(credentials.Value)
+	return creds, ok
+}
+
+// ContextWithMetricLabel returns a copy of ctx carrying the metric label name
+// with the given value. The label is applied to the metrics of requests sent
+// with the returned context if name was passed to WithMetricLabels, and is
+// ignored otherwise.
+func ContextWithMetricLabel(ctx context.Context, name, value string) context.Context {
+	parent := metricLabelsFromContext(ctx)
+	labels := make(map[string]string, len(parent)+1)
+	for k, v := range parent {
+		labels[k] = v
+	}
+	labels[name] = value
+	return context.WithValue(ctx, metricLabelsContextKey{}, labels)
+}
+
+// metricLabelsFromContext returns the labels set by ContextWithMetricLabel.
+func metricLabelsFromContext(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(metricLabelsContextKey{}).(map[string]string)
+	return labels
+}
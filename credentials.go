@@ -0,0 +1,293 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// CredentialsProvider returns the credentials requests are signed with for
+// cfg, for use with AWS SDK clients. They are resolved exactly like by
+// NewSigV4RoundTripper, including assuming the configured role, and retrieved
+// once with ctx to fail early. Of the opts, only those about credentials, such
+// as WithCredentialsHTTPClient and WithMFATokenProvider, apply.
+func CredentialsProvider(ctx context.Context, cfg *SigV4Config, opts ...Option) (*credentials.Credentials, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	rc, err := resolveCredentials(ctx, cfg, &o)
+	if err != nil {
+		return nil, err
+	}
+	if roleARN := rc.roleARN; roleARN != "" && !o.lazyCredentials {
+		if _, err := rc.creds.GetWithContext(ctx); err != nil {
+			return nil, fmt.Errorf("could not assume role %s: %w", roleARN, err)
+		}
+	}
+	return rc.creds, nil
+}
+
+// resolvedCredentials are the credentials resolved for a SigV4Config.
+type resolvedCredentials struct {
+	// creds are the credentials requests are signed with, which are those
+	// of the assumed role if roleARN is set.
+	creds *credentials.Credentials
+	// sess is the AWS session the source credentials and region were
+	// resolved with, and stsSess the one roles are assumed with.
+	sess    *session.Session
+	stsSess *session.Session
+	// source are the source credentials, which are only retrieved if they
+	// aren't lazy.
+	source credentials.Value
+	// roleChain are the roles assumed in order before roleARN, each with the
+	// credentials of the previous one.
+	roleChain   []string
+	roleARN     string
+	assumedRole *assumedRoleRecorder
+	// partition is the AWS partition of the region, such as aws-cn, or empty
+	// if the region isn't known to be in any.
+	partition string
+}
+
+// resolveCredentials resolves the credentials of cfg with the AWS default
+// credential chain. The source credentials are retrieved with ctx, unless they
+// are lazy or anonymous.
+func resolveCredentials(ctx context.Context, cfg *SigV4Config, o *options) (*resolvedCredentials, error) {
+	if cfg.MFASerial != "" && o.mfaTokenProvider == nil {
+		return nil, fmt.Errorf("mfa_serial requires an MFA token provider, set with WithMFATokenProvider")
+	}
+
+	creds := credentials.NewStaticCredentials(cfg.AccessKey, string(cfg.SecretKey), "")
+	if cfg.AccessKey == "" && cfg.SecretKey == "" {
+		creds = nil
+	}
+	if cfg.Anonymous {
+		creds = credentials.AnonymousCredentials
+	}
+	if cfg.ClearEnvAfterLoad {
+		v, ok, err := clearEnvCredentials()
+		if err != nil {
+			return nil, err
+		}
+		// The AWS SDK uses credentials from the environment unless a
+		// profile is set.
+		if ok && creds == nil && cfg.Profile == "" {
+			creds = credentials.NewStaticCredentialsFromCreds(v)
+		}
+	}
+
+	// The endpoints only affect requests made to resolve credentials, such as
+	// to STS, as signed requests are sent to the URL they were made for.
+	useFIPSEndpoint := endpoints.FIPSEndpointStateDisabled
+	if cfg.UseFIPSEndpoint || cfg.UseFIPSSTSEndpoint {
+		useFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	useDualStackEndpoint := endpoints.DualStackEndpointStateUnset
+	if cfg.UseDualStackEndpoint {
+		useDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+
+	// The mode has been validated, an unset one falls back to the
+	// environment.
+	var imdsEndpointMode endpoints.EC2IMDSEndpointModeState
+	_ = imdsEndpointMode.SetFromString(cfg.EC2MetadataEndpointMode)
+
+	region := cfg.Region
+	if region == "" && cfg.Endpoint != "" {
+		region, _ = parseEndpoint(cfg.Endpoint)
+	}
+
+	// An explicit shared config file is meant to be used in full, such as for
+	// its role settings, which the AWS SDK otherwise only reads if enabled
+	// through AWS_SDK_LOAD_CONFIG.
+	sharedConfigState := session.SharedConfigStateFromEnv
+	if cfg.SharedConfigFile != "" {
+		sharedConfigState = session.SharedConfigEnable
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region:               aws.String(region),
+			Credentials:          creds,
+			UseFIPSEndpoint:      useFIPSEndpoint,
+			UseDualStackEndpoint: useDualStackEndpoint,
+			HTTPClient:           o.credentialsHTTPClient,
+		},
+		Profile:             cfg.Profile,
+		SharedConfigFiles:   sharedConfigFiles(cfg),
+		SharedConfigState:   sharedConfigState,
+		EC2IMDSEndpoint:     cfg.EC2MetadataEndpoint,
+		EC2IMDSEndpointMode: imdsEndpointMode,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create new AWS session: %w", err)
+	}
+	rc := &resolvedCredentials{creds: sess.Config.Credentials, sess: sess, stsSess: sess}
+	// Roles are assumed with a web identity token rather than with source
+	// credentials.
+	if !o.lazyCredentials && !cfg.Anonymous && cfg.WebIdentityTokenFile == "" {
+		rc.source, err = sess.Config.Credentials.GetWithContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not get SigV4 credentials: %w", contextError(ctx, err))
+		}
+	}
+	if aws.StringValue(sess.Config.Region) == "" && !cfg.Anonymous {
+		return nil, fmt.Errorf("could not determine AWS region: set region in the sigv4 config or AWS_REGION")
+	}
+
+	rc.roleARN = cfg.RoleARN
+	if n := len(cfg.RoleARNChain); n > 0 {
+		rc.roleChain, rc.roleARN = cfg.RoleARNChain[:n-1], cfg.RoleARNChain[n-1]
+	}
+	if cfg.RoleProfile != "" {
+		configFile := cfg.SharedConfigFile
+		if configFile == "" {
+			configFile = sharedConfigFilename()
+		}
+		rc.roleARN, err = sharedConfigRoleARN(configFile, cfg.RoleProfile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load role_profile: %w", err)
+		}
+	}
+
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), aws.StringValue(sess.Config.Region)); ok {
+		rc.partition = p.ID()
+		if err := checkPartition(cfg, rc, aws.StringValue(sess.Config.Region)); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.AssumeRoleRegion != "" {
+		// The legacy global endpoint would be in us-east-1 regardless.
+		rc.stsSess = sess.Copy(&aws.Config{
+			Region:              aws.String(cfg.AssumeRoleRegion),
+			STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+		})
+	}
+	if cfg.STSEndpoint != "" {
+		// Unlike endpoint, which is only the endpoint signed requests are
+		// meant for, sts_endpoint replaces the endpoint roles are assumed
+		// with, such as for a proxy or a local mock.
+		rc.stsSess = rc.stsSess.Copy(&aws.Config{Endpoint: aws.String(cfg.STSEndpoint)})
+	}
+	switch {
+	case cfg.WebIdentityTokenFile != "":
+		rc.source = credentials.Value{ProviderName: stscreds.WebIdentityProviderName}
+		rc.creds = credentials.NewCredentials(stscreds.NewWebIdentityRoleProviderWithOptions(
+			sts.New(rc.stsSess), rc.roleARN, cfg.RoleSessionName, stscreds.FetchTokenPath(cfg.WebIdentityTokenFile),
+			func(p *stscreds.WebIdentityRoleProvider) {
+				p.ExpiryWindow = time.Duration(cfg.CredentialsRefreshWindow)
+				p.Duration = time.Duration(cfg.SessionDuration)
+			},
+		))
+	case rc.roleARN != "":
+		// role_session_name and session_duration apply to every role of
+		// the chain, and mfa_serial to the first one.
+		opts := assumeRoleOptions(cfg, o.mfaTokenProvider)
+		rc.assumedRole = &assumedRoleRecorder{STS: sts.New(chainedRoleSession(rc.stsSess, rc.roleChain, opts)), logger: o.logger}
+		rc.creds = stscreds.NewCredentialsWithClient(rc.assumedRole, rc.roleARN, chainedRoleOptions(opts, len(rc.roleChain)))
+	}
+
+	if cfg.VerifyCredentials {
+		if o.lazyCredentials {
+			return nil, fmt.Errorf("verify_credentials can't be used with lazily retrieved credentials")
+		}
+		if err := verifyCredentials(ctx, rc); err != nil {
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// checkPartition returns an error if the roles or STS region of cfg are in
+// another partition than region, as partitions such as aws-cn and aws-us-gov
+// have separate accounts and endpoints.
+func checkPartition(cfg *SigV4Config, rc *resolvedCredentials, region string) error {
+	for _, roleARN := range append(append([]string(nil), rc.roleChain...), rc.roleARN) {
+		if a, err := arn.Parse(roleARN); err == nil && a.Partition != rc.partition {
+			return fmt.Errorf("role %s is in partition %s, but region %s is in partition %s", roleARN, a.Partition, region, rc.partition)
+		}
+	}
+	if cfg.AssumeRoleRegion != "" {
+		if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), cfg.AssumeRoleRegion); ok && p.ID() != rc.partition {
+			return fmt.Errorf("assume_role_region %s is in partition %s, but region %s is in partition %s", cfg.AssumeRoleRegion, p.ID(), region, rc.partition)
+		}
+	}
+	return nil
+}
+
+// verifyCredentials checks that the credentials of rc are accepted by AWS with
+// an STS GetCallerIdentity call, which requires no permissions, so that invalid
+// credentials are reported at startup rather than on the first request.
+func verifyCredentials(ctx context.Context, rc *resolvedCredentials) error {
+	client := sts.New(rc.stsSess, &aws.Config{Credentials: rc.creds})
+	if _, err := client.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{}); err != nil {
+		return fmt.Errorf("could not verify SigV4 credentials: %w", contextError(ctx, err))
+	}
+	return nil
+}
+
+// credentialEnvVars are the environment variables the AWS SDK reads static
+// credentials from.
+var credentialEnvVars = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_ACCESS_KEY",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SECRET_KEY",
+	"AWS_SESSION_TOKEN",
+}
+
+var (
+	envCredentialsMtx sync.Mutex
+	envCredentials    *credentials.Value
+)
+
+// clearEnvCredentials returns the static credentials of the environment and
+// unsets their variables. The credentials are kept for the life of the
+// process, so that round trippers created after the variables were cleared
+// with the same config, and retrievals after the credentials were expired,
+// still use them.
+func clearEnvCredentials() (credentials.Value, bool, error) {
+	envCredentialsMtx.Lock()
+	defer envCredentialsMtx.Unlock()
+
+	if v, err := credentials.NewEnvCredentials().Get(); err == nil {
+		envCredentials = &v
+	}
+	for _, name := range credentialEnvVars {
+		if err := os.Unsetenv(name); err != nil {
+			return credentials.Value{}, false, fmt.Errorf("could not clear %s: %w", name, err)
+		}
+	}
+	if envCredentials == nil {
+		return credentials.Value{}, false, nil
+	}
+	return *envCredentials, true, nil
+}
@@ -0,0 +1,311 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsProvider(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	stsCalls := fakeSTS(t)
+
+	t.Run("Static", func(t *testing.T) {
+		creds, err := CredentialsProvider(context.Background(), &SigV4Config{Region: "us-east-2", AccessKey: "test-id", SecretKey: "secret"})
+		require.NoError(t, err)
+		v, err := creds.Get()
+		require.NoError(t, err)
+		require.Equal(t, "test-id", v.AccessKeyID)
+		require.Equal(t, "secret", v.SecretAccessKey)
+		require.Empty(t, *stsCalls)
+	})
+
+	t.Run("Role", func(t *testing.T) {
+		creds, err := CredentialsProvider(context.Background(), &SigV4Config{
+			Region:    "us-east-2",
+			AccessKey: "test-id",
+			SecretKey: "secret",
+			RoleARN:   "arn:aws:iam::123456789012:role/target",
+		})
+		require.NoError(t, err)
+		require.Len(t, *stsCalls, 1)
+		require.Contains(t, (*stsCalls)[0].Get("Authorization"), "Credential=test-id/")
+
+		v, err := creds.Get()
+		require.NoError(t, err)
+		require.Equal(t, "ASIA1", v.AccessKeyID)
+		require.Equal(t, "role-token", v.SessionToken)
+		require.Len(t, *stsCalls, 1)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := CredentialsProvider(context.Background(), &SigV4Config{AccessKey: "test-id"})
+		require.Error(t, err)
+	})
+}
+
+func TestResolveCredentials_Endpoints(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	for _, tc := range []struct {
+		name        string
+		cfg         SigV4Config
+		fips        endpoints.FIPSEndpointState
+		dualStack   endpoints.DualStackEndpointState
+		stsEndpoint string
+	}{
+		{name: "Default", stsEndpoint: "https://sts.amazonaws.com"},
+		{name: "FIPS", cfg: SigV4Config{UseFIPSEndpoint: true}, fips: endpoints.FIPSEndpointStateEnabled, stsEndpoint: "https://sts-fips.us-east-2.amazonaws.com"},
+		{name: "FIPS STS", cfg: SigV4Config{UseFIPSSTSEndpoint: true}, fips: endpoints.FIPSEndpointStateEnabled, stsEndpoint: "https://sts-fips.us-east-2.amazonaws.com"},
+		{name: "Dualstack", cfg: SigV4Config{UseDualStackEndpoint: true}, dualStack: endpoints.DualStackEndpointStateEnabled, stsEndpoint: "https://sts.us-east-2.api.aws"},
+		{name: "STS endpoint", cfg: SigV4Config{STSEndpoint: "http://localhost:4566"}, stsEndpoint: "http://localhost:4566"},
+		{name: "Service endpoint", cfg: SigV4Config{Endpoint: "https://aps.example.com"}, stsEndpoint: "https://sts.amazonaws.com"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.Region, cfg.AccessKey, cfg.SecretKey = "us-east-2", "test-id", "secret"
+			rc, err := resolveCredentials(context.Background(), &cfg, &options{})
+			require.NoError(t, err)
+
+			if tc.fips == endpoints.FIPSEndpointStateUnset {
+				tc.fips = endpoints.FIPSEndpointStateDisabled
+			}
+			require.Equal(t, tc.fips, rc.sess.Config.UseFIPSEndpoint)
+			require.Equal(t, tc.dualStack, rc.sess.Config.UseDualStackEndpoint)
+			require.Equal(t, tc.stsEndpoint, sts.New(rc.stsSess).Endpoint)
+		})
+	}
+}
+
+// clearCredentialChain leaves the EC2 instance metadata service as the only
+// source of the AWS default credential chain.
+func clearCredentialChain(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_SDK_LOAD_CONFIG", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", "")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE", "")
+	dir := t.TempDir()
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+}
+
+// blockingMetadataServer returns the URL of an EC2 instance metadata service
+// that never responds, for credentials whose retrieval blocks until its
+// context is done.
+func blockingMetadataServer(t *testing.T) string {
+	clearCredentialChain(t)
+	done := make(chan struct{})
+	imds := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	t.Cleanup(imds.Close)
+	t.Cleanup(func() { close(done) })
+	return imds.URL
+}
+
+func TestResolveCredentials_EC2Metadata(t *testing.T) {
+	clearCredentialChain(t)
+
+	var paths []string
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/latest/api/token":
+			w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+			fmt.Fprint(w, "imds-token")
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "instance-role")
+		case "/latest/meta-data/iam/security-credentials/instance-role":
+			fmt.Fprint(w, `{"Code":"Success","Type":"AWS-HMAC","AccessKeyId":"ASIAIMDS","SecretAccessKey":"imds-secret","Token":"imds-session","Expiration":"2099-01-01T00:00:00Z"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer imds.Close()
+
+	rc, err := resolveCredentials(context.Background(), &SigV4Config{
+		Region:              "us-east-2",
+		EC2MetadataEndpoint: imds.URL,
+	}, &options{})
+	require.NoError(t, err)
+	require.Equal(t, "ASIAIMDS", rc.source.AccessKeyID)
+	require.Contains(t, paths, "/latest/meta-data/iam/security-credentials/instance-role")
+
+	// The mode selects the default endpoint when none is set.
+	rc, err = resolveCredentials(context.Background(), &SigV4Config{
+		Region:                  "us-east-2",
+		EC2MetadataEndpointMode: "ipv6",
+	}, &options{lazyCredentials: true})
+	require.NoError(t, err)
+	require.Equal(t, "http://[fd00:ec2::254]", ec2metadata.New(rc.sess).Endpoint)
+}
+
+func TestNewSigV4RoundTripper_VerifyCredentials(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	for _, tc := range []struct {
+		name      string
+		verify    bool
+		status    int
+		wantCalls int
+		wantErr   string
+	}{
+		{name: "Disabled", status: http.StatusOK},
+		{name: "Valid", verify: true, status: http.StatusOK, wantCalls: 1},
+		{name: "Access denied", verify: true, status: http.StatusForbidden, wantCalls: 1, wantErr: "could not verify SigV4 credentials: AccessDenied: User is not authorized"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls []url.Values
+			client := &http.Client{Transport: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+				form, err := url.ParseQuery(string(body))
+				if err != nil {
+					return nil, err
+				}
+				form.Set("Authorization", req.Header.Get("Authorization"))
+				calls = append(calls, form)
+
+				resp := `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:iam::123456789012:user/prometheus</Arn>
+    <UserId>AIDA</UserId>
+    <Account>123456789012</Account>
+  </GetCallerIdentityResult>
+  <ResponseMetadata><RequestId>request-id</RequestId></ResponseMetadata>
+</GetCallerIdentityResponse>`
+				if tc.status != http.StatusOK {
+					resp = `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <Error><Type>Sender</Type><Code>AccessDenied</Code><Message>User is not authorized</Message></Error>
+  <RequestId>request-id</RequestId>
+</ErrorResponse>`
+				}
+				return &http.Response{
+					StatusCode: tc.status,
+					Header:     http.Header{"Content-Type": []string{"text/xml"}},
+					Body:       io.NopCloser(strings.NewReader(resp)),
+					Request:    req,
+				}, nil
+			})}
+
+			_, err := NewSigV4RoundTripper(&SigV4Config{
+				Region:            "us-east-2",
+				AccessKey:         "test-id",
+				SecretKey:         "secret",
+				VerifyCredentials: tc.verify,
+			}, nil, WithCredentialsHTTPClient(client))
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Len(t, calls, tc.wantCalls)
+			for _, call := range calls {
+				require.Equal(t, "GetCallerIdentity", call.Get("Action"))
+				require.Contains(t, call.Get("Authorization"), "Credential=test-id/")
+			}
+		})
+	}
+
+	_, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:            "us-east-2",
+		AccessKey:         "test-id",
+		SecretKey:         "secret",
+		VerifyCredentials: true,
+	}, nil, WithLazyCredentials())
+	require.ErrorContains(t, err, "lazily retrieved credentials")
+}
+
+func TestResolveCredentials_Partitions(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	for _, tc := range []struct {
+		config      string
+		partition   string
+		stsEndpoint string
+		scope       string
+	}{
+		{
+			config:      "region: cn-north-1\naccess_key: test-id\nsecret_key: secret\nrole_arn: arn:aws-cn:iam::123456789012:role/target\n",
+			partition:   "aws-cn",
+			stsEndpoint: "https://sts.cn-north-1.amazonaws.com.cn",
+			scope:       "/cn-north-1/aps/aws4_request",
+		},
+		{
+			config:      "region: us-gov-west-1\naccess_key: test-id\nsecret_key: secret\nrole_arn: arn:aws-us-gov:iam::123456789012:role/target\n",
+			partition:   "aws-us-gov",
+			stsEndpoint: "https://sts.us-gov-west-1.amazonaws.com",
+			scope:       "/us-gov-west-1/aps/aws4_request",
+		},
+	} {
+		t.Run(tc.partition, func(t *testing.T) {
+			cfg, err := ParseConfig([]byte(tc.config))
+			require.NoError(t, err)
+			rc, err := resolveCredentials(context.Background(), cfg, &options{})
+			require.NoError(t, err)
+			require.Equal(t, tc.partition, rc.partition)
+			require.Equal(t, tc.stsEndpoint, sts.New(rc.stsSess).Endpoint)
+
+			// Requests are scoped to the region without the role.
+			cfg.RoleARN = ""
+			var gotReq *http.Request
+			rt, err := NewSigV4RoundTripper(cfg, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				gotReq = req
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}))
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+			require.NoError(t, err)
+			_, err = rt.RoundTrip(req)
+			require.NoError(t, err)
+			require.Contains(t, gotReq.Header.Get("Authorization"), tc.scope)
+		})
+	}
+
+	for _, cfg := range []SigV4Config{
+		{Region: "cn-north-1", RoleARN: "arn:aws:iam::123456789012:role/target"},
+		{Region: "us-gov-west-1", RoleARNChain: []string{"arn:aws-us-gov:iam::123456789012:role/landing", "arn:aws:iam::123456789012:role/target"}},
+		{Region: "cn-north-1", RoleARN: "arn:aws-cn:iam::123456789012:role/target", AssumeRoleRegion: "us-east-1"},
+	} {
+		cfg.AccessKey, cfg.SecretKey = "test-id", "secret"
+		_, err := resolveCredentials(context.Background(), &cfg, &options{})
+		require.ErrorContains(t, err, "is in partition", "config %+v", cfg)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the metrics exposed by a round tripper created with
+// WithRegisterer.
+type metrics struct {
+	requests *prometheus.CounterVec
+	// contextLabels are the label names taken from the request context.
+	contextLabels []string
+
+	signed              prometheus.Counter
+	signingDuration     prometheus.Histogram
+	credentialRefreshes prometheus.Counter
+	expiredTokenRetries prometheus.Counter
+}
+
+// newMetrics creates the metrics and registers them with reg. Metrics already
+// registered by another round tripper are shared. The values of the
+// contextLabels are set with ContextWithMetricLabel.
+func newMetrics(reg prometheus.Registerer, contextLabels []string) (*metrics, error) {
+	m := &metrics{contextLabels: contextLabels}
+	var err error
+	if m.requests, err = register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sigv4_requests_total",
+		Help: "Total number of signed requests that received a response, by status class and whether they were retried.",
+	}, append([]string{"status_class", "retried"}, contextLabels...))); err != nil {
+		return nil, err
+	}
+	if m.signed, err = register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sigv4_requests_signed_total",
+		Help: "Total number of times requests were signed, including every retry.",
+	})); err != nil {
+		return nil, err
+	}
+	if m.signingDuration, err = register(reg, prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sigv4_signing_duration_seconds",
+		Help:    "Time taken to sign requests, including retrieving credentials.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})); err != nil {
+		return nil, err
+	}
+	if m.credentialRefreshes, err = register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sigv4_credential_refreshes_total",
+		Help: "Total number of times signing credentials were retrieved because they were expired or not retrieved yet.",
+	})); err != nil {
+		return nil, err
+	}
+	if m.expiredTokenRetries, err = register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sigv4_expired_token_retries_total",
+		Help: "Total number of requests retried after being rejected for an expired security token.",
+	})); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// register registers c with reg, or returns the collector of the same type
+// registered before.
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) (C, error) {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			return c, err
+		}
+		existing, ok := are.ExistingCollector.(C)
+		if !ok {
+			return c, err
+		}
+		return existing, nil
+	}
+	return c, nil
+}
+
+// observeSign records that a request was signed, which took d.
+func (m *metrics) observeSign(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.signed.Inc()
+	m.signingDuration.Observe(d.Seconds())
+}
+
+// observeCredentialRefresh records that credentials were retrieved.
+func (m *metrics) observeCredentialRefresh() {
+	if m == nil {
+		return
+	}
+	m.credentialRefreshes.Inc()
+}
+
+// observeExpiredTokenRetry records that a request is retried for an expired
+// token.
+func (m *metrics) observeExpiredTokenRetry() {
+	if m == nil {
+		return
+	}
+	m.expiredTokenRetries.Inc()
+}
+
+// observeResponse counts a response received for a signed request sent with
+// ctx.
+func (m *metrics) observeResponse(ctx context.Context, resp *http.Response, retried bool) {
+	if m == nil {
+		return
+	}
+	labels := append(make([]string, 0, 2+len(m.contextLabels)),
+		strconv.Itoa(resp.StatusCode/100)+"xx",
+		strconv.FormatBool(retried),
+	)
+	ctxLabels := metricLabelsFromContext(ctx)
+	for _, name := range m.contextLabels {
+		labels = append(labels, ctxLabels[name])
+	}
+	m.requests.WithLabelValues(labels...).Inc()
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigV4RoundTripper_RequestsMetric(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := newMetrics(reg, nil)
+	require.NoError(t, err)
+
+	var responses []fakeResponse
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			r := responses[0]
+			responses = responses[1:]
+			return &http.Response{StatusCode: r.status, Body: &trackingBody{Reader: strings.NewReader(r.body)}}, nil
+		}),
+		metrics: m,
+		creds:   credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func(r ...fakeResponse) {
+		responses = r
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	roundTrip(fakeResponse{http.StatusOK, ""})
+	roundTrip(
+		fakeResponse{http.StatusForbidden, "ExpiredTokenException"},
+		fakeResponse{http.StatusServiceUnavailable, ""},
+	)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("2xx", "false")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("5xx", "true")))
+	require.Equal(t, 2, testutil.CollectAndCount(m.requests))
+
+	// Round trippers sharing a registry share the metric.
+	m2, err := newMetrics(reg, nil)
+	require.NoError(t, err)
+	require.Same(t, m.requests, m2.requests)
+}
+
+func TestSigV4RoundTripper_ContextMetricLabels(t *testing.T) {
+	m, err := newMetrics(prometheus.NewRegistry(), []string{"tenant"})
+	require.NoError(t, err)
+
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		metrics: m,
+		creds:   credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func(ctx context.Context) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	ctx := ContextWithMetricLabel(context.Background(), "tenant", "team-a")
+	roundTrip(ctx)
+	roundTrip(ctx)
+	// Labels that weren't configured are ignored.
+	roundTrip(ContextWithMetricLabel(context.Background(), "user", "alice"))
+
+	require.Equal(t, 2.0, testutil.ToFloat64(m.requests.WithLabelValues("2xx", "false", "team-a")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("2xx", "false", "")))
+	require.Equal(t, 2, testutil.CollectAndCount(m.requests))
+}
+
+func TestSigV4RoundTripper_SigningMetrics(t *testing.T) {
+	m, err := newMetrics(prometheus.NewRegistry(), nil)
+	require.NoError(t, err)
+
+	provider := &expiringProvider{now: time.Now}
+	var responses []fakeResponse
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			r := responses[0]
+			responses = responses[1:]
+			return &http.Response{StatusCode: r.status, Body: &trackingBody{Reader: strings.NewReader(r.body)}}, nil
+		}),
+		metrics: m,
+		creds:   credentials.NewCredentials(provider),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func(r ...fakeResponse) {
+		responses = r
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	// The first request retrieves credentials.
+	roundTrip(fakeResponse{http.StatusOK, ""})
+	require.Equal(t, 1.0, testutil.ToFloat64(m.signed))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.credentialRefreshes))
+	require.Zero(t, testutil.ToFloat64(m.expiredTokenRetries))
+	require.Equal(t, 1, testutil.CollectAndCount(m.signingDuration))
+
+	// Cached credentials are reused.
+	roundTrip(fakeResponse{http.StatusOK, ""})
+	require.Equal(t, 2.0, testutil.ToFloat64(m.signed))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.credentialRefreshes))
+
+	// A rejected token is refreshed, and the request signed again.
+	roundTrip(
+		fakeResponse{http.StatusForbidden, "ExpiredTokenException"},
+		fakeResponse{http.StatusOK, ""},
+	)
+	require.Equal(t, 4.0, testutil.ToFloat64(m.signed))
+	require.Equal(t, 2.0, testutil.ToFloat64(m.credentialRefreshes))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.expiredTokenRetries))
+}
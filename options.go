@@ -0,0 +1,178 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"hash"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures optional behavior of the http.RoundTripper returned by
+// NewSigV4RoundTripper.
+type Option func(*options)
+
+type options struct {
+	signObserver              func(req *http.Request, amzDate string)
+	transformCanonicalRequest func(canonical string) string
+	rejectSignedNext          bool
+	postSignMutationCheck     bool
+	logger                    *slog.Logger
+	registerer                prometheus.Registerer
+	metricLabels              []string
+	regionHeader              string
+	serviceHeader             string
+	lazyCredentials           bool
+	credentialsHTTPClient     *http.Client
+	mfaTokenProvider          func() (string, error)
+	newHash                   func() hash.Hash
+	newNonce                  func() (string, error)
+}
+
+// WithSignObserver registers a function that is called for every signed
+// request right before it is handed to the next RoundTripper. amzDate is the
+// signing time in the format used by the X-Amz-Date header, which helps
+// diagnosing requests rejected due to clock skew.
+func WithSignObserver(fn func(req *http.Request, amzDate string)) Option {
+	return func(o *options) {
+		o.signObserver = fn
+	}
+}
+
+// WithCanonicalRequestTransform registers a function that rewrites the SigV4
+// canonical request before it is hashed into the string to sign. This is an
+// escape hatch for services with non-standard canonicalization rules.
+//
+// Use with care: any change to the canonical request that the receiving
+// service doesn't make as well results in requests being rejected.
+func WithCanonicalRequestTransform(fn func(canonical string) string) Option {
+	return func(o *options) {
+		o.transformCanonicalRequest = fn
+	}
+}
+
+// WithDigest replaces SHA256 with the digest returned by newHash for hashing
+// the payload and canonical request, and for deriving the signature. This is
+// an escape hatch for SigV4-like backends using another digest.
+//
+// Only SHA256 is supported by AWS; requests signed with any other digest are
+// rejected by AWS services.
+func WithDigest(newHash func() hash.Hash) Option {
+	return func(o *options) {
+		o.newHash = newHash
+	}
+}
+
+// WithDoubleSigningCheck makes NewSigV4RoundTripper fail if the next
+// RoundTripper is a SigV4 signer itself. Requests would otherwise be signed
+// twice, which services reject with confusing errors.
+func WithDoubleSigningCheck() Option {
+	return func(o *options) {
+		o.rejectSignedNext = true
+	}
+}
+
+// WithPostSignMutationCheck attaches the request as it was signed to the
+// requests handed to the next RoundTripper, for AssertNoPostSignMutation to
+// compare them with. It is meant for tests, and adds an allocation to every
+// request otherwise.
+func WithPostSignMutationCheck() Option {
+	return func(o *options) {
+		o.postSignMutationCheck = true
+	}
+}
+
+// WithLogger sets the logger NewSigV4RoundTripper reports the resolved
+// credential source and region to. Secrets are never logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithRegisterer registers metrics about signed requests, signing, credential
+// refreshes and expired token retries with reg.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registerer = reg
+	}
+}
+
+// WithMetricLabels adds labels with the given names to the
+// sigv4_requests_total metric registered with WithRegisterer. Their values are
+// taken from the request context, as set by ContextWithMetricLabel. Only
+// labels with a small number of distinct values should be used, such as
+// tenants.
+func WithMetricLabels(names ...string) Option {
+	return func(o *options) {
+		o.metricLabels = names
+	}
+}
+
+// WithRegionFromHeader makes requests carrying the header headerName be signed
+// for the region given in it instead of the configured one. The header is
+// removed from requests before they are signed and sent.
+func WithRegionFromHeader(headerName string) Option {
+	return func(o *options) {
+		o.regionHeader = headerName
+	}
+}
+
+// WithServiceFromHeader makes requests carrying the header headerName be
+// signed for the service given in it instead of the configured one. The header
+// is removed from requests before they are signed and sent.
+func WithServiceFromHeader(headerName string) Option {
+	return func(o *options) {
+		o.serviceHeader = headerName
+	}
+}
+
+// WithLazyCredentials defers retrieving credentials from NewSigV4RoundTripper
+// to the first request, which avoids blocking on slow credential providers at
+// startup. Errors retrieving credentials are then returned by the requests.
+func WithLazyCredentials() Option {
+	return func(o *options) {
+		o.lazyCredentials = true
+	}
+}
+
+// WithCredentialsHTTPClient sets the HTTP client used to retrieve credentials,
+// such as calls to STS to assume a role, for example to go through a proxy.
+// It doesn't affect the next RoundTripper signed requests are sent with. By
+// default, the HTTP client of the AWS SDK is used.
+func WithCredentialsHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.credentialsHTTPClient = client
+	}
+}
+
+// WithMFATokenProvider sets the function returning the one-time code of the
+// MFA device set with mfa_serial, for roles that require MFA to be assumed. It
+// is called whenever the role is assumed, for example to prompt for the code.
+func WithMFATokenProvider(fn func() (string, error)) Option {
+	return func(o *options) {
+		o.mfaTokenProvider = fn
+	}
+}
+
+// WithNonceGenerator sets the function generating the X-Amz-Nonce header added
+// with add_nonce_header, for example to make nonces predictable in tests. By
+// default, nonces are 16 random bytes, hex encoded.
+func WithNonceGenerator(fn func() (string, error)) Option {
+	return func(o *options) {
+		o.newNonce = fn
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// signedRequestContextKey is the context key of the request as it was signed,
+// which is attached to requests handed off to the next round tripper.
+type signedRequestContextKey struct{}
+
+// AssertNoPostSignMutation returns an http.RoundTripper that fails requests
+// whose signed headers were changed after they were signed by a round tripper
+// of this package, for example by a middleware wrapping the transport passed
+// to NewSigV4RoundTripper. Valid requests are handed off to next.
+//
+// It is meant to be used in tests to diagnose middleware ordering that
+// invalidates signatures. The round tripper signing the requests must be
+// created with WithPostSignMutationCheck.
+func AssertNoPostSignMutation(next http.RoundTripper) http.RoundTripper {
+	return postSignMutationCheck{next: next}
+}
+
+type postSignMutationCheck struct {
+	next http.RoundTripper
+}
+
+func (c postSignMutationCheck) RoundTrip(req *http.Request) (*http.Response, error) {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return nil, fmt.Errorf("request to %s isn't signed", req.URL)
+	}
+
+	signReq, ok := req.Context().Value(signedRequestContextKey{}).(*http.Request)
+	if !ok {
+		return nil, fmt.Errorf("request to %s wasn't signed by a round tripper created with WithPostSignMutationCheck", req.URL)
+	}
+	if signReq.Header.Get("Authorization") != auth {
+		return nil, fmt.Errorf("the Authorization header of request to %s was changed after signing", req.URL)
+	}
+
+	snapshot := signedHeaderValues(signReq, auth)
+	got := signedHeaderValues(req, auth)
+	for name, want := range snapshot {
+		if !slices.Equal(want, got[name]) {
+			return nil, fmt.Errorf("signed header %s of request to %s was changed after signing from %q to %q", name, req.URL, want, got[name])
+		}
+	}
+	return c.next.RoundTrip(req)
+}
+
+// withSignedRequest returns a shallow copy of req carrying signReq, the
+// request as it was signed, for post-sign mutation checks. The signed header
+// values are only compared by the checks.
+func withSignedRequest(req, signReq *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), signedRequestContextKey{}, signReq))
+}
+
+// signedHeaderValues returns the values of the headers listed as signed in the
+// Authorization header auth, by lower case name.
+func signedHeaderValues(req *http.Request, auth string) map[string][]string {
+	_, signedHeaders, _ := strings.Cut(auth, "SignedHeaders=")
+	signedHeaders, _, _ = strings.Cut(signedHeaders, ",")
+
+	values := make(map[string][]string)
+	for _, name := range strings.Split(signedHeaders, ";") {
+		values[name] = nil
+	}
+	if _, ok := values["host"]; ok {
+		values["host"] = []string{canonicalHost(req)}
+	}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if _, ok := values[lk]; ok && lk != "host" {
+			values[lk] = append(values[lk], v...)
+		}
+	}
+	return values
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testPostSignConfig = &SigV4Config{Region: "us-east-2", AccessKey: "test-id", SecretKey: "secret"}
+
+func TestAssertNoPostSignMutation(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	var sent bool
+	transport := AssertNoPostSignMutation(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent = true
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+
+	roundTrip := func(middleware func(req *http.Request)) error {
+		sent = false
+		rt, err := NewSigV4RoundTripper(testPostSignConfig, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			middleware(req)
+			return transport.RoundTrip(req)
+		}), WithPostSignMutationCheck())
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		_, err = rt.RoundTrip(req)
+		return err
+	}
+
+	require.NoError(t, roundTrip(func(*http.Request) {}))
+	require.True(t, sent)
+
+	// Unsigned headers may be changed.
+	require.NoError(t, roundTrip(func(req *http.Request) { req.Header.Set("User-Agent", "middleware") }))
+	require.True(t, sent)
+
+	err := roundTrip(func(req *http.Request) { req.Header.Set("Content-Type", "application/json") })
+	require.ErrorContains(t, err, "signed header content-type of request to https://example.com was changed after signing")
+	require.False(t, sent)
+
+	err = roundTrip(func(req *http.Request) { req.Host = "other.example.com" })
+	require.ErrorContains(t, err, "signed header host")
+	require.False(t, sent)
+
+	err = roundTrip(func(req *http.Request) { req.Header.Set("Authorization", "Bearer token") })
+	require.ErrorContains(t, err, "the Authorization header of request to https://example.com was changed after signing")
+	require.False(t, sent)
+}
+
+func TestAssertNoPostSignMutation_WithoutOption(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	// Without the option, requests are handed to next as they are.
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	rt, err := NewSigV4RoundTripper(testPostSignConfig, AssertNoPostSignMutation(RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.ErrorContains(t, err, "wasn't signed by a round tripper created with WithPostSignMutationCheck")
+
+	var gotReq *http.Request
+	rt, err = NewSigV4RoundTripper(testPostSignConfig, RoundTripperFunc(func(got *http.Request) (*http.Response, error) {
+		gotReq = got
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Same(t, req, gotReq)
+}
+
+func TestAssertNoPostSignMutation_IdenticalRequests(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	var sent int
+	transport := AssertNoPostSignMutation(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+
+	// The second request gets the same signature as the first one, and is
+	// checked while the first one is still in flight.
+	var (
+		rt     http.RoundTripper
+		nested bool
+	)
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		return req
+	}
+	rt, err := NewSigV4RoundTripper(testPostSignConfig, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if !nested {
+			nested = true
+			_, err := rt.RoundTrip(newRequest())
+			require.NoError(t, err)
+		}
+		return transport.RoundTrip(req)
+	}), WithPostSignMutationCheck())
+	require.NoError(t, err)
+	rt.(*sigV4RoundTripper).timeNow = func() time.Time { return testSignTime }
+
+	_, err = rt.RoundTrip(newRequest())
+	require.NoError(t, err)
+	require.Equal(t, 2, sent)
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ServiceDefaults describes signing behavior specific to an AWS service.
+type ServiceDefaults struct {
+	// PayloadHashHeader sends the payload hash in the X-Amz-Content-Sha256
+	// header, as required by services such as S3.
+	PayloadHashHeader bool
+	// ContentType is the Content-Type the service expects request bodies to
+	// be sent with. It is set on requests without one if default_content_type
+	// is enabled.
+	ContentType string
+	// GlobalRegion is the region requests to a global service are signed for,
+	// regardless of the configured region. It is empty for regional services.
+	GlobalRegion string
+}
+
+var (
+	servicesMtx sync.RWMutex
+	// services holds the defaults of AWS services that deviate from the
+	// generic SigV4 behavior. Services not listed use the zero value.
+	services = map[string]ServiceDefaults{
+		"aoss":             {PayloadHashHeader: true},
+		"aps":              {},
+		"bedrock":          {ContentType: "application/json"},
+		"bedrock-runtime":  {ContentType: "application/json"},
+		"dynamodb":         {ContentType: "application/x-amz-json-1.0"},
+		"es":               {},
+		"glacier":          {PayloadHashHeader: true},
+		"kinesis":          {ContentType: "application/x-amz-json-1.1"},
+		"logs":             {ContentType: "application/x-amz-json-1.1"},
+		"s3":               {PayloadHashHeader: true},
+		"s3-object-lambda": {PayloadHashHeader: true},
+		"s3-outposts":      {PayloadHashHeader: true},
+		"timestream":       {ContentType: "application/x-amz-json-1.0"},
+	}
+)
+
+// RegisterServiceDefaults sets the signing defaults of service, replacing any
+// previously registered ones. It allows signing requests for services this
+// package has no built-in knowledge of.
+func RegisterServiceDefaults(service string, defaults ServiceDefaults) {
+	servicesMtx.Lock()
+	defer servicesMtx.Unlock()
+	services[service] = defaults
+}
+
+// serviceDefaults returns the signing defaults of service.
+func serviceDefaults(service string) ServiceDefaults {
+	servicesMtx.RLock()
+	defer servicesMtx.RUnlock()
+	return services[service]
+}
+
+// regionLabelRegexp matches the hostname label of AWS endpoints that is the
+// region, such as us-east-2 or us-gov-west-1.
+var regionLabelRegexp = regexp.MustCompile(`^[a-z]{2}(-gov|-iso[a-z]?)?-[a-z]+-[0-9]+$`)
+
+// endpointPrefixes maps the hostname prefixes of AWS endpoints that differ
+// from the name of the service used for signing.
+var endpointPrefixes = map[string]string{
+	"aps-workspaces": "aps",
+	"s3-accesspoint": "s3",
+}
+
+// regionSuffixServices are the services whose endpoints have their name after
+// the region rather than before it, such as OpenSearch domains. The service
+// of other endpoints with a label after the region isn't guessed.
+var regionSuffixServices = map[string]bool{
+	"es":   true,
+	"aoss": true,
+}
+
+// parseEndpoint returns the region and service of an AWS endpoint URL, such as
+// https://aps-workspaces.us-east-2.amazonaws.com or
+// https://search-domain.us-east-2.es.amazonaws.com. Empty strings are
+// returned for what can't be determined from the hostname, so that the
+// configured or default service applies rather than a guess.
+func parseEndpoint(endpoint string) (region, service string) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", ""
+	}
+	host := strings.TrimSuffix(u.Hostname(), ".cn")
+	host, ok := strings.CutSuffix(host, ".amazonaws.com")
+	if !ok {
+		return "", ""
+	}
+
+	// The region is searched from the right, as labels on the left, such as
+	// bucket names, are chosen by users and can look like regions.
+	labels := strings.Split(host, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		label := labels[i]
+		if !regionLabelRegexp.MatchString(label) {
+			continue
+		}
+		region = label
+		switch {
+		case i+1 < len(labels) && labels[i+1] == "vpce":
+			// VPC endpoints, such as
+			// vpce-1a2b.aps-workspaces.us-east-1.vpce.amazonaws.com, keep
+			// the service before the region.
+			if i > 0 {
+				service = labels[i-1]
+			}
+		case i+1 < len(labels):
+			if regionSuffixServices[labels[i+1]] {
+				service = labels[i+1]
+			}
+		case i > 0:
+			service = labels[i-1]
+			if service == "dualstack" && i > 1 {
+				service = labels[i-2]
+			}
+		}
+		break
+	}
+	if region == "" && len(labels) > 0 {
+		// Global endpoints, such as sts.amazonaws.com, have no region.
+		service = labels[len(labels)-1]
+	}
+
+	service = strings.TrimSuffix(service, "-fips")
+	if s, ok := endpointPrefixes[service]; ok {
+		service = s
+	}
+	return region, service
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint, region, service string
+	}{
+		{"https://aps-workspaces.us-east-2.amazonaws.com/workspaces/ws-1/api/v1/remote_write", "us-east-2", "aps"},
+		{"https://aps-workspaces-fips.us-gov-west-1.amazonaws.com", "us-gov-west-1", "aps"},
+		{"https://search-domain-abc123.eu-west-1.es.amazonaws.com", "eu-west-1", "es"},
+		{"https://abc123.us-east-1.aoss.amazonaws.com", "us-east-1", "aoss"},
+		{"https://abc123.execute-api.ap-southeast-2.amazonaws.com/prod", "ap-southeast-2", "execute-api"},
+		{"https://bucket.s3.dualstack.us-west-2.amazonaws.com/key", "us-west-2", "s3"},
+		{"https://eu-logs-1.s3.eu-west-1.amazonaws.com", "eu-west-1", "s3"},
+		{"https://vpce-0123456789abcdef0-abcdefgh.aps-workspaces.us-east-1.vpce.amazonaws.com", "us-east-1", "aps"},
+		{"https://bucket.vpce-0123456789abcdef0-abcdefgh.s3.us-east-1.vpce.amazonaws.com", "us-east-1", "s3"},
+		{"https://myap-123456789012.s3-accesspoint.us-east-1.amazonaws.com", "us-east-1", "s3"},
+		{"https://myap-123456789012.s3-accesspoint.dualstack.us-east-1.amazonaws.com", "us-east-1", "s3"},
+		{"https://ap-123456789012.s3-object-lambda.us-east-2.amazonaws.com", "us-east-2", "s3-object-lambda"},
+		{"https://abc123.us-east-1.unknown.amazonaws.com", "us-east-1", ""},
+		{"https://bedrock-runtime.us-east-1.amazonaws.com:443", "us-east-1", "bedrock-runtime"},
+		{"https://aps-workspaces.cn-north-1.amazonaws.com.cn", "cn-north-1", "aps"},
+		{"https://sts.amazonaws.com", "", "sts"},
+		{"https://prometheus.example.com", "", ""},
+		{"http://localhost:9090", "", ""},
+		{"::not a url", "", ""},
+	} {
+		region, service := parseEndpoint(tc.endpoint)
+		require.Equal(t, tc.region, region, tc.endpoint)
+		require.Equal(t, tc.service, service, tc.endpoint)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/defaults"
+)
+
+// sharedConfigFilename returns the path of the AWS shared config file, which
+// can be overridden through the AWS_CONFIG_FILE environment variable.
+func sharedConfigFilename() string {
+	if filename := os.Getenv("AWS_CONFIG_FILE"); filename != "" {
+		return filename
+	}
+	return defaults.SharedConfigFilename()
+}
+
+// sharedCredentialsFilename returns the path of the AWS shared credentials
+// file, which can be overridden through the AWS_SHARED_CREDENTIALS_FILE
+// environment variable.
+func sharedCredentialsFilename() string {
+	if filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); filename != "" {
+		return filename
+	}
+	return defaults.SharedCredentialsFilename()
+}
+
+// sharedConfigFiles returns the shared config and credentials files to load,
+// in the order of the AWS SDK, with later files taking precedence. It returns
+// nil if cfg sets neither, leaving them to the AWS SDK defaults.
+func sharedConfigFiles(cfg *SigV4Config) []string {
+	if cfg.SharedConfigFile == "" && cfg.SharedCredentialsFile == "" {
+		return nil
+	}
+	var files []string
+	if cfg.SharedConfigFile != "" {
+		files = append(files, cfg.SharedConfigFile)
+	} else if on, _ := strconv.ParseBool(os.Getenv("AWS_SDK_LOAD_CONFIG")); on {
+		files = append(files, sharedConfigFilename())
+	}
+	if cfg.SharedCredentialsFile != "" {
+		return append(files, cfg.SharedCredentialsFile)
+	}
+	return append(files, sharedCredentialsFilename())
+}
+
+// sharedConfigRoleARN returns the role_arn configured for profile in the AWS
+// shared config file filename.
+func sharedConfigRoleARN(filename, profile string) (string, error) {
+	values, err := readSharedConfigProfile(filename, profile)
+	if err != nil {
+		return "", err
+	}
+	roleARN := values["role_arn"]
+	if roleARN == "" {
+		return "", fmt.Errorf("profile %q in %s has no role_arn", profile, filename)
+	}
+	return roleARN, nil
+}
+
+// readSharedConfigProfile returns the key/value pairs of profile in the AWS
+// shared config file filename.
+func readSharedConfigProfile(filename, profile string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read AWS shared config: %w", err)
+	}
+	defer f.Close()
+
+	// The default profile is the only one not prefixed with "profile" in the
+	// shared config file.
+	section := "profile " + profile
+	if profile == "default" {
+		section = profile
+	}
+
+	var (
+		values  map[string]string
+		current string
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			current = strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			if current == section && values == nil {
+				values = map[string]string{}
+			}
+			continue
+		}
+		if current != section {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			values[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read AWS shared config: %w", err)
+	}
+	if values == nil {
+		return nil, fmt.Errorf("profile %q not found in %s", profile, filename)
+	}
+	return values, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedConfigRoleARN(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(filename, []byte(`# comment
+[default]
+role_arn = arn:aws:iam::123456789012:role/default
+
+[profile  other]
+; comment
+region=us-east-2
+role_arn=arn:aws:iam::123456789012:role/other
+`), 0o600))
+
+	roleARN, err := sharedConfigRoleARN(filename, "default")
+	require.NoError(t, err)
+	require.Equal(t, "arn:aws:iam::123456789012:role/default", roleARN)
+
+	roleARN, err = sharedConfigRoleARN(filename, "other")
+	require.NoError(t, err)
+	require.Equal(t, "arn:aws:iam::123456789012:role/other", roleARN)
+
+	_, err = sharedConfigRoleARN(filename, "missing")
+	require.ErrorContains(t, err, `profile "missing" not found`)
+
+	_, err = sharedConfigRoleARN(filepath.Join(t.TempDir(), "missing"), "default")
+	require.Error(t, err)
+}
+
+func TestNewSigV4RoundTripper_SharedFiles(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_SDK_LOAD_CONFIG", "")
+
+	dir := t.TempDir()
+	credentialsFile := filepath.Join(dir, "credentials")
+	require.NoError(t, os.WriteFile(credentialsFile, []byte(`[tenant-a]
+aws_access_key_id = tenant-a-id
+aws_secret_access_key = tenant-a-secret
+`), 0o600))
+	configFile := filepath.Join(dir, "config")
+	require.NoError(t, os.WriteFile(configFile, []byte(`[profile tenant-a]
+region = eu-west-1
+`), 0o600))
+
+	var gotReq *http.Request
+	rt, err := NewSigV4RoundTripper(&SigV4Config{
+		Profile:               "tenant-a",
+		SharedCredentialsFile: credentialsFile,
+		SharedConfigFile:      configFile,
+	}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Contains(t, gotReq.Header.Get("Authorization"), "Credential=tenant-a-id/")
+	require.Contains(t, gotReq.Header.Get("Authorization"), "/eu-west-1/aps/aws4_request")
+
+	// Profiles only present in the default files aren't found.
+	_, err = NewSigV4RoundTripper(&SigV4Config{
+		Region:                "us-east-2",
+		Profile:               "tenant-b",
+		SharedCredentialsFile: credentialsFile,
+	}, nil)
+	require.Error(t, err)
+}
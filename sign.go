@@ -0,0 +1,144 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxPresignExpires is the longest time presigned URLs are accepted by AWS.
+const maxPresignExpires = 7 * 24 * time.Hour
+
+// Signer signs requests in place, for when requests can't be sent through the
+// http.RoundTripper returned by NewSigV4RoundTripper. Requests are signed
+// exactly as by the round tripper, but none of its retry behavior applies.
+type Signer struct {
+	rt *sigV4RoundTripper
+}
+
+// NewSigner returns a Signer for the given configuration. Credentials are
+// resolved like by NewSigV4RoundTripper.
+func NewSigner(cfg *SigV4Config, opts ...Option) (*Signer, error) {
+	return NewSignerContext(context.Background(), cfg, opts...)
+}
+
+// NewSignerContext returns a Signer like NewSigner, but retrieves credentials
+// with ctx, like NewSigV4RoundTripperContext.
+func NewSignerContext(ctx context.Context, cfg *SigV4Config, opts ...Option) (*Signer, error) {
+	rt, err := newSigV4RoundTripperFromConfig(ctx, cfg, http.DefaultTransport, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{rt: rt}, nil
+}
+
+// Sign signs req, retrieving credentials with ctx. The body of req is read
+// and replaced with an in-memory copy, unless it is left untouched for an
+// unsigned payload, and the signature headers are set on req. A request that
+// is signed again, for example to retry it, gets a fresh signature.
+func (s *Signer) Sign(ctx context.Context, req *http.Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p, release, err := s.rt.prepare(req, false)
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	if !p.passthrough {
+		body := p.body
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+	_, err = s.rt.sign(ctx, req, p.payloadHash, p.service, p.region)
+	return err
+}
+
+// Sign signs req with a Signer for cfg. Credentials are resolved with ctx for
+// every call, so a Signer should be reused when signing many requests.
+func Sign(ctx context.Context, cfg *SigV4Config, req *http.Request) error {
+	s, err := NewSignerContext(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	return s.Sign(ctx, req)
+}
+
+// Presign returns the URL of req with a signature in its query string, valid
+// for expires, for when the signature can't be sent in headers, such as for
+// links handed out to browsers. Credentials are retrieved with ctx. Headers
+// set on req are signed as well and have to be sent along with the URL. req is
+// left untouched, and a body is read through its GetBody to be hashed.
+func (s *Signer) Presign(ctx context.Context, req *http.Request, expires time.Duration) (string, error) {
+	if expires < time.Second || expires > maxPresignExpires {
+		return "", fmt.Errorf("presigned URLs must expire within 1s to %s, got %s", maxPresignExpires, expires)
+	}
+	if s.rt.signer.asymmetric {
+		return "", fmt.Errorf("presigned URLs are not supported with signing_algorithm %q", SigningAlgorithmSigV4A)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// The request is presigned as a clone, leaving the body of req to be sent
+	// along with the URL. The body is only read to be hashed if it can be
+	// replayed.
+	signReq := req.Clone(ctx)
+	signReq.Body = nil
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return "", fmt.Errorf("failed to presign request: %w", err)
+		}
+		signReq.Body = body
+	} else if req.Body != nil && req.Body != http.NoBody {
+		return "", fmt.Errorf("failed to presign request: the body of the request can't be read without GetBody")
+	}
+	p, release, err := s.rt.prepare(signReq, true)
+	defer release()
+	if err != nil {
+		return "", err
+	}
+
+	creds, err := s.rt.retrieveCredentials(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign request: %w", err)
+	}
+	signReq.Header.Del("Authorization")
+	for _, header := range sigv4HeaderDenylist {
+		if !s.rt.signer.isSignedHeader(header) {
+			signReq.Header.Del(header)
+		}
+	}
+	s.rt.signer.presign(signReq, p.payloadHash, creds, p.service, p.region, s.rt.timeNow().UTC(), expires)
+	return signReq.URL.String(), nil
+}
+
+// Presign returns a presigned URL of req like Signer.Presign, with a Signer
+// for cfg.
+func Presign(ctx context.Context, cfg *SigV4Config, req *http.Request, expires time.Duration) (string, error) {
+	s, err := NewSignerContext(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+	return s.Presign(ctx, req, expires)
+}
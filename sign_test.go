@@ -0,0 +1,149 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigner_MatchesRoundTripper(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	cfg := &SigV4Config{Region: "us-east-2", AccessKey: "test-id", SecretKey: "secret", CompressBody: true}
+	clock := func() time.Time { return testSignTime }
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com/api/v1/../v1/remote_write?a=b+c", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		return req
+	}
+
+	var gotReq *http.Request
+	var gotBody []byte
+	rt, err := newSigV4RoundTripperFromConfig(context.Background(), cfg, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		var err error
+		gotBody, err = io.ReadAll(req.Body)
+		require.NoError(t, err)
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+	rt.timeNow = clock
+	_, err = rt.RoundTrip(newRequest())
+	require.NoError(t, err)
+
+	s, err := NewSigner(cfg)
+	require.NoError(t, err)
+	s.rt.timeNow = clock
+	req := newRequest()
+	require.NoError(t, s.Sign(context.Background(), req))
+
+	require.NotEmpty(t, req.Header.Get("Authorization"))
+	require.Equal(t, gotReq.Header.Get("Authorization"), req.Header.Get("Authorization"))
+	require.Equal(t, gotReq.Header.Get("X-Amz-Date"), req.Header.Get("X-Amz-Date"))
+	require.Equal(t, gotReq.URL.String(), req.URL.String())
+
+	// The signed request carries the body it was signed for, and can be read
+	// again.
+	for i := 0; i < 2; i++ {
+		body, err := req.GetBody()
+		require.NoError(t, err)
+		data, err := io.ReadAll(body)
+		require.NoError(t, err)
+		require.Equal(t, gotBody, data)
+	}
+}
+
+func TestSign(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	require.NoError(t, Sign(context.Background(), &SigV4Config{Region: "us-east-2", AccessKey: "test-id", SecretKey: "secret"}, req))
+	require.Contains(t, req.Header.Get("Authorization"), "Credential=test-id/")
+	require.NotEmpty(t, req.Header.Get("X-Amz-Date"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Sign(ctx, &SigV4Config{Region: "us-east-2", AccessKey: "test-id", SecretKey: "secret"}, req)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Credentials are resolved with ctx, which bounds Sign and Presign.
+	cfg := &SigV4Config{Region: "us-east-2", EC2MetadataEndpoint: blockingMetadataServer(t)}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = Sign(ctx, cfg, req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = Presign(ctx, cfg, req, time.Minute)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestPresign(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	cfg := &SigV4Config{Region: "us-east-2", Service: "s3", AccessKey: "test-id", SecretKey: "secret"}
+	req, err := http.NewRequest(http.MethodGet, "https://bucket.s3.amazonaws.com/key?versionId=1", nil)
+	require.NoError(t, err)
+	presigned, err := Presign(context.Background(), cfg, req, 10*time.Minute)
+	require.NoError(t, err)
+
+	u, err := url.Parse(presigned)
+	require.NoError(t, err)
+	require.Equal(t, "bucket.s3.amazonaws.com", u.Host)
+	require.Equal(t, "/key", u.Path)
+	query := u.Query()
+	require.Equal(t, "1", query.Get("versionId"))
+	require.Equal(t, "AWS4-HMAC-SHA256", query.Get("X-Amz-Algorithm"))
+	require.Regexp(t, `^test-id/\d{8}/us-east-2/s3/aws4_request$`, query.Get("X-Amz-Credential"))
+	require.Equal(t, "600", query.Get("X-Amz-Expires"))
+	require.Equal(t, "host", query.Get("X-Amz-SignedHeaders"))
+	require.NotEmpty(t, query.Get("X-Amz-Date"))
+	require.Len(t, query.Get("X-Amz-Signature"), 64)
+	require.Empty(t, req.Header.Get("Authorization"))
+
+	_, err = Presign(context.Background(), cfg, req, 8*24*time.Hour)
+	require.ErrorContains(t, err, "presigned URLs must expire within")
+}
+
+func TestPresign_Body(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	cfg := &SigV4Config{Region: "us-east-2", Service: "es", AccessKey: "test-id", SecretKey: "secret", CompressBody: true}
+	req, err := http.NewRequest(http.MethodPost, "https://search-domain.us-east-2.es.amazonaws.com/_search", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	_, err = Presign(context.Background(), cfg, req, 10*time.Minute)
+	require.NoError(t, err)
+
+	// The body of the request is left to be sent as is.
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(body))
+	require.Empty(t, req.Header.Get("Content-Encoding"))
+
+	// Bodies that can't be replayed can't be hashed without consuming them.
+	req, err = http.NewRequest(http.MethodPost, "https://search-domain.us-east-2.es.amazonaws.com/_search", io.NopCloser(strings.NewReader("Hello, world!")))
+	require.NoError(t, err)
+	_, err = Presign(context.Background(), cfg, req, 10*time.Minute)
+	require.ErrorContains(t, err, "can't be read without GetBody")
+}
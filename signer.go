@@ -0,0 +1,386 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const (
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat    = "20060102T150405Z"
+	shortDateFormat  = "20060102"
+	scopeTerminator  = "aws4_request"
+
+	// unsignedPayload is used in place of the payload hash for requests whose
+	// body isn't included in the signature.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// signerIgnoredHeaders are never included in the signature, matching the
+// behavior of the AWS SDK signer.
+var signerIgnoredHeaders = map[string]struct{}{
+	"Authorization":   {},
+	"User-Agent":      {},
+	"X-Amzn-Trace-Id": {},
+}
+
+// v4Signer computes AWS Signature Version 4 signatures. It follows the
+// canonicalization rules of the AWS SDK signer, but allows hooking into the
+// signing process where the SDK doesn't.
+//
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+type v4Signer struct {
+	// transformCanonicalRequest, if set, is applied to the canonical request
+	// before it is hashed into the string to sign.
+	transformCanonicalRequest func(canonical string) string
+	// signUserAgent includes the User-Agent header in the signature, which
+	// is otherwise ignored.
+	signUserAgent bool
+	// signedHeaders are included in the signature even if they are ignored
+	// by default, keyed by their canonical name.
+	signedHeaders map[string]struct{}
+	// newHash returns the digest used for hashing and HMAC. It is SHA256 if
+	// nil, which is the only one supported by AWS.
+	newHash func() hash.Hash
+	// disablePathEscaping signs the path as sent rather than escaping it
+	// again, for services such as S3 whose paths contain meaningful
+	// sequences like double slashes or encoded separators.
+	disablePathEscaping bool
+	// asymmetric signs with SigV4A rather than SigV4, so that signatures are
+	// valid in all regions of regionSet, or the signing region if empty.
+	asymmetric bool
+	regionSet  []string
+}
+
+// sign signs req with creds for the given service and region. payloadHash is
+// the hex encoded SHA256 of the request body, and is ignored if the request
+// carries its own X-Amz-Content-Sha256 header. The headers added to req by
+// signing, including Authorization, are returned.
+func (s *v4Signer) sign(req *http.Request, payloadHash string, creds credentials.Value, service, region string, signTime time.Time) (http.Header, error) {
+	signed := make(http.Header)
+	setHeader := func(k, v string) {
+		req.Header.Set(k, v)
+		signed.Set(k, v)
+	}
+
+	amzDate := signTime.UTC().Format(amzDateFormat)
+	setHeader("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		setHeader("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	if h := req.Header.Get("X-Amz-Content-Sha256"); h != "" {
+		payloadHash = h
+	} else if serviceDefaults(service).PayloadHashHeader || payloadHash == unsignedPayload {
+		setHeader("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	if s.asymmetric {
+		regionSet := s.regionSet
+		if len(regionSet) == 0 {
+			regionSet = []string{region}
+		}
+		setHeader("X-Amz-Region-Set", strings.Join(regionSet, ","))
+
+		signedHeaders, canonicalHeaders := s.buildCanonicalHeaders(req)
+		signature, err := s.asymmetricSignature(req, canonicalHeaders, signedHeaders, payloadHash, creds, service, signTime)
+		if err != nil {
+			return nil, err
+		}
+		setHeader("Authorization", asymmetricSigningAlgorithm+" Credential="+creds.AccessKeyID+"/"+asymmetricSigningScope(service, signTime)+
+			", SignedHeaders="+signedHeaders+", Signature="+signature)
+		return signed, nil
+	}
+
+	signedHeaders, canonicalHeaders := s.buildCanonicalHeaders(req)
+	signature := s.signature(req, canonicalHeaders, signedHeaders, payloadHash, creds, service, region, signTime)
+	setHeader("Authorization", signingAlgorithm+" Credential="+creds.AccessKeyID+"/"+signingScope(service, region, signTime)+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return signed, nil
+}
+
+// presign signs req for the given service and region like sign, but with the
+// signature in the query string rather than headers, so that the URL of req
+// can be used by itself until expires has passed. Unlike sign, no headers are
+// added to req, so any headers it already carries have to be sent along with
+// the URL.
+func (s *v4Signer) presign(req *http.Request, payloadHash string, creds credentials.Value, service, region string, signTime time.Time, expires time.Duration) {
+	if h := req.Header.Get("X-Amz-Content-Sha256"); h != "" {
+		payloadHash = h
+	} else if service == "s3" || service == "s3-object-lambda" {
+		// S3 doesn't know the payload of presigned requests in advance.
+		payloadHash = unsignedPayload
+	}
+
+	signedHeaders, canonicalHeaders := s.buildCanonicalHeaders(req)
+	query := req.URL.Query()
+	query.Set("X-Amz-Algorithm", signingAlgorithm)
+	query.Set("X-Amz-Credential", creds.AccessKeyID+"/"+signingScope(service, region, signTime))
+	query.Set("X-Amz-Date", signTime.UTC().Format(amzDateFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	if creds.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	query.Set("X-Amz-SignedHeaders", signedHeaders)
+	req.URL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	signature := s.signature(req, canonicalHeaders, signedHeaders, payloadHash, creds, service, region, signTime)
+	req.URL.RawQuery += "&X-Amz-Signature=" + signature
+}
+
+// signature returns the hex encoded signature of req, given its canonical
+// headers block and signed header names.
+func (s *v4Signer) signature(req *http.Request, canonicalHeaders, signedHeaders, payloadHash string, creds credentials.Value, service, region string, signTime time.Time) string {
+	stringToSign := strings.Join([]string{
+		signingAlgorithm,
+		signTime.UTC().Format(amzDateFormat),
+		signingScope(service, region, signTime),
+		s.hash([]byte(s.canonicalRequest(req, canonicalHeaders, signedHeaders, payloadHash))),
+	}, "\n")
+
+	key := s.hmac([]byte("AWS4"+creds.SecretAccessKey), []byte(signTime.UTC().Format(shortDateFormat)))
+	key = s.hmac(key, []byte(region))
+	key = s.hmac(key, []byte(service))
+	key = s.hmac(key, []byte(scopeTerminator))
+	return hex.EncodeToString(s.hmac(key, []byte(stringToSign)))
+}
+
+// canonicalRequest returns the canonical request of req that is hashed into
+// the string to sign.
+func (s *v4Signer) canonicalRequest(req *http.Request, canonicalHeaders, signedHeaders, payloadHash string) string {
+	uri := canonicalURI(req.URL)
+	if !s.disablePathEscaping {
+		uri = escapePath(uri)
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		canonicalQuery(req.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	if s.transformCanonicalRequest != nil {
+		canonicalRequest = s.transformCanonicalRequest(canonicalRequest)
+	}
+	return canonicalRequest
+}
+
+// signingScope returns the credential scope of signatures made at signTime.
+func signingScope(service, region string, signTime time.Time) string {
+	return strings.Join([]string{signTime.UTC().Format(shortDateFormat), region, service, scopeTerminator}, "/")
+}
+
+// hash returns the hex encoded digest of data.
+func (s *v4Signer) hash(data []byte) string {
+	if s.newHash == nil {
+		return hashSHA256(data)
+	}
+	h := s.newHash()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hmac returns the HMAC of data with key, using the digest of the signer.
+func (s *v4Signer) hmac(key, data []byte) []byte {
+	if s.newHash == nil {
+		return hmacSHA256(key, data)
+	}
+	h := hmac.New(s.newHash, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// buildCanonicalHeaders returns the semicolon separated list of signed header
+// names and the canonical headers block of the canonical request.
+func (s *v4Signer) buildCanonicalHeaders(req *http.Request) (string, string) {
+	values := map[string][]string{"host": {canonicalHost(req)}}
+	for k, v := range req.Header {
+		if s.isIgnoredHeader(k) {
+			continue
+		}
+		lk := strings.ToLower(k)
+		values[lk] = append(values[lk], v...)
+	}
+
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, k := range names {
+		vs := make([]string, len(values[k]))
+		for i, v := range values[k] {
+			vs[i] = trimHeaderValue(v)
+		}
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(vs, ","))
+		b.WriteByte('\n')
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+// countSignedHeaders returns the number of headers of req that are signed,
+// including Host, before any headers are added by signing.
+func (s *v4Signer) countSignedHeaders(req *http.Request) int {
+	n := 1
+	for k := range req.Header {
+		if !s.isIgnoredHeader(k) && !strings.EqualFold(k, "Host") {
+			n++
+		}
+	}
+	return n
+}
+
+// isIgnoredHeader reports whether the header k is excluded from signing.
+func (s *v4Signer) isIgnoredHeader(k string) bool {
+	k = http.CanonicalHeaderKey(k)
+	if k == "User-Agent" && s.signUserAgent || s.isSignedHeader(k) {
+		return false
+	}
+	_, ok := signerIgnoredHeaders[k]
+	return ok
+}
+
+// isSignedHeader reports whether the header k was explicitly configured to be
+// signed.
+func (s *v4Signer) isSignedHeader(k string) bool {
+	_, ok := s.signedHeaders[http.CanonicalHeaderKey(k)]
+	return ok
+}
+
+// trimHeaderValue removes leading and trailing whitespace from v and collapses
+// sequential spaces into a single one.
+func trimHeaderValue(v string) string {
+	v = strings.TrimSpace(v)
+	for strings.Contains(v, "  ") {
+		v = strings.ReplaceAll(v, "  ", " ")
+	}
+	return v
+}
+
+// canonicalHost returns the host the request is sent to, without the port if
+// it is the default port of the request scheme.
+func canonicalHost(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	return stripDefaultPort(host, req.URL.Scheme)
+}
+
+// stripDefaultPort removes the port from host if it is the default port of
+// scheme.
+func stripDefaultPort(host, scheme string) string {
+	i := strings.LastIndexByte(host, ':')
+	if i == -1 || strings.IndexByte(host[i:], ']') != -1 {
+		return host
+	}
+	switch port := host[i+1:]; {
+	case port == "80" && scheme == "http", port == "443" && scheme == "https":
+		return host[:i]
+	}
+	return host
+}
+
+// canonicalURI returns the escaped path of u, or "/" if it is empty.
+func canonicalURI(u *url.URL) string {
+	uri := u.EscapedPath()
+	if u.Opaque != "" {
+		uri = "/" + strings.Join(strings.Split(u.Opaque, "/")[3:], "/")
+	}
+	if uri == "" {
+		uri = "/"
+	}
+	return uri
+}
+
+// canonicalQuery returns the query of u sorted by key and value, with spaces
+// encoded as %20.
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	for k := range query {
+		sort.Strings(query[k])
+	}
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// escapePath percent-encodes every byte of path except for unreserved
+// characters and the path separator.
+func escapePath(path string) string {
+	const upperhex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if isUnreserved(c) || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(upperhex[c>>4])
+		b.WriteByte(upperhex[c&0xf])
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' ||
+		'a' <= c && c <= 'z' ||
+		'0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// PayloadHash returns the hex encoded SHA256 of body, as used in the canonical
+// request of SigV4 signatures. As body is consumed, a reader with the same
+// contents is returned in its place. A nil body is hashed as empty.
+func PayloadHash(body io.Reader) (string, io.Reader, error) {
+	var buf bytes.Buffer
+	if body == nil {
+		return hashSHA256(nil), &buf, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.TeeReader(body, &buf)); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), &buf, nil
+}
+
+func hashSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
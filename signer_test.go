@@ -0,0 +1,230 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	signer "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/require"
+)
+
+var testSignTime = time.Date(2021, 6, 1, 10, 20, 30, 0, time.UTC)
+
+// TestV4Signer_SDKParity ensures v4Signer produces the same signatures as the
+// AWS SDK signer it replaces.
+func TestV4Signer_SDKParity(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		service string
+		token   string
+		headers map[string][]string
+	}{
+		{name: "Simple", method: http.MethodGet, url: "https://example.com"},
+		{name: "Body", method: http.MethodPost, url: "https://example.com/api/v1/remote_write", body: "Hello, world!"},
+		{name: "Session token", method: http.MethodPost, url: "https://example.com", body: "Hello, world!", token: "token"},
+		{name: "Query", method: http.MethodGet, url: "https://example.com/?b=2&a=1&a=0&c=with%20space&d=plus+sign"},
+		{name: "Escaped path", method: http.MethodGet, url: "https://example.com/a%20b/c:d/ü"},
+		{name: "Default port", method: http.MethodGet, url: "https://example.com:443/"},
+		{name: "Other port", method: http.MethodGet, url: "https://example.com:8443/"},
+		{name: "S3", method: http.MethodPut, url: "https://bucket.s3.amazonaws.com/key", body: "data", service: "s3"},
+		{
+			name:    "Bedrock",
+			method:  http.MethodPost,
+			url:     "https://bedrock-runtime.us-east-2.amazonaws.com/model/anthropic.claude-v2:1/invoke-with-response-stream",
+			body:    `{"prompt":"Hello"}`,
+			service: "bedrock-runtime",
+			headers: map[string][]string{"Content-Type": {"application/json"}},
+		},
+		{name: "S3 Object Lambda", method: http.MethodGet, url: "https://ap-123456789012.s3-object-lambda.us-east-2.amazonaws.com/key", service: "s3-object-lambda"},
+		{
+			name:   "Headers",
+			method: http.MethodPost,
+			url:    "https://example.com",
+			body:   "{}",
+			headers: map[string][]string{
+				"Content-Type":    {"application/json"},
+				"X-Amz-Meta-Foo":  {"  a   b  ", "c"},
+				"User-Agent":      {"test"},
+				"X-Amzn-Trace-Id": {"trace"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.service == "" {
+				tc.service = "aps"
+			}
+			newRequest := func() *http.Request {
+				req, err := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+				require.NoError(t, err)
+				for k, v := range tc.headers {
+					req.Header[k] = v
+				}
+				return req
+			}
+			creds := credentials.NewStaticCredentials("test-id", "secret", tc.token)
+
+			sdkReq := newRequest()
+			_, err := signer.NewSigner(creds).Sign(sdkReq, bytes.NewReader([]byte(tc.body)), tc.service, "us-east-2", testSignTime)
+			require.NoError(t, err)
+
+			credValues, err := creds.Get()
+			require.NoError(t, err)
+			req := newRequest()
+			var s v4Signer
+			headers, err := s.sign(req, hashSHA256([]byte(tc.body)), credValues, tc.service, "us-east-2", testSignTime)
+			require.NoError(t, err)
+
+			require.Equal(t, sdkReq.Header.Get("Authorization"), req.Header.Get("Authorization"))
+			for k := range headers {
+				require.Equal(t, sdkReq.Header.Get(k), req.Header.Get(k), k)
+			}
+		})
+	}
+}
+
+func TestV4Signer_TransformCanonicalRequest(t *testing.T) {
+	creds := credentials.Value{AccessKeyID: "test-id", SecretAccessKey: "secret"}
+	sign := func(s v4Signer, method string) string {
+		req, err := http.NewRequest(method, "https://example.com", nil)
+		require.NoError(t, err)
+		_, err = s.sign(req, hashSHA256(nil), creds, "aps", "us-east-2", testSignTime)
+		require.NoError(t, err)
+		return req.Header.Get("Authorization")
+	}
+
+	t.Run("No-op", func(t *testing.T) {
+		var called bool
+		s := v4Signer{transformCanonicalRequest: func(canonical string) string {
+			called = true
+			return canonical
+		}}
+		require.Equal(t, sign(v4Signer{}, http.MethodPost), sign(s, http.MethodPost))
+		require.True(t, called)
+	})
+
+	t.Run("Tweak", func(t *testing.T) {
+		s := v4Signer{transformCanonicalRequest: func(canonical string) string {
+			return strings.Replace(canonical, "POST\n", "PUT\n", 1)
+		}}
+		require.NotEqual(t, sign(v4Signer{}, http.MethodPost), sign(s, http.MethodPost))
+		require.Equal(t, sign(v4Signer{}, http.MethodPut), sign(s, http.MethodPost))
+	})
+}
+
+func TestV4Signer_SignUserAgent(t *testing.T) {
+	creds := credentials.Value{AccessKeyID: "test-id", SecretAccessKey: "secret"}
+
+	for _, signUserAgent := range []bool{false, true} {
+		req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", "Prometheus/2.0")
+
+		s := v4Signer{signUserAgent: signUserAgent}
+		_, err = s.sign(req, hashSHA256(nil), creds, "aps", "us-east-2", testSignTime)
+		require.NoError(t, err)
+
+		if signUserAgent {
+			require.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=host;user-agent;x-amz-date,")
+		} else {
+			require.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date,")
+		}
+	}
+}
+
+func TestPayloadHash(t *testing.T) {
+	hash, body, err := PayloadHash(strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	require.Equal(t, "315f5bdb76d078c43b8ac0064e4a0164612b1fce77c869345bfc94c75894edd3", hash)
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(data))
+
+	hash, body, err = PayloadHash(nil)
+	require.NoError(t, err)
+	require.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", hash)
+	data, err = io.ReadAll(body)
+	require.NoError(t, err)
+	require.Empty(t, data)
+}
+
+func TestV4Signer_Digest(t *testing.T) {
+	creds := credentials.Value{AccessKeyID: "test-id", SecretAccessKey: "secret"}
+	sign := func(s v4Signer) *http.Request {
+		req, err := http.NewRequest(http.MethodPut, "https://bucket.s3.amazonaws.com/key", nil)
+		require.NoError(t, err)
+		_, err = s.sign(req, s.hash([]byte("Hello, world!")), creds, "s3", "us-east-2", testSignTime)
+		require.NoError(t, err)
+		return req
+	}
+	signature := func(req *http.Request) string {
+		_, sig, _ := strings.Cut(req.Header.Get("Authorization"), "Signature=")
+		return sig
+	}
+
+	// The default digest is SHA256.
+	def := sign(v4Signer{})
+	require.Equal(t, def.Header, sign(v4Signer{newHash: sha256.New}).Header)
+	require.Equal(t, hashSHA256([]byte("Hello, world!")), def.Header.Get("X-Amz-Content-Sha256"))
+	require.Len(t, signature(def), sha256.Size*2)
+
+	custom := sign(v4Signer{newHash: sha512.New})
+	require.Len(t, custom.Header.Get("X-Amz-Content-Sha256"), sha512.Size*2)
+	require.Len(t, signature(custom), sha512.Size*2)
+}
+
+// TestV4Signer_PresignSDKParity ensures v4Signer presigns URLs like the AWS SDK
+// signer.
+func TestV4Signer_PresignSDKParity(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		url     string
+		service string
+		token   string
+	}{
+		{name: "Simple", url: "https://example.com/api/v1/query?query=up", service: "aps"},
+		{name: "Session token", url: "https://example.com/api/v1/query?query=up", service: "aps", token: "token"},
+		{name: "S3", url: "https://bucket.s3.amazonaws.com/key", service: "s3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			creds := credentials.NewStaticCredentials("test-id", "secret", tc.token)
+
+			sdkReq, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			require.NoError(t, err)
+			_, err = signer.NewSigner(creds).Presign(sdkReq, nil, tc.service, "us-east-2", 15*time.Minute, testSignTime)
+			require.NoError(t, err)
+
+			credValues, err := creds.Get()
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			require.NoError(t, err)
+			var s v4Signer
+			s.presign(req, hashSHA256(nil), credValues, tc.service, "us-east-2", testSignTime, 15*time.Minute)
+
+			require.Equal(t, sdkReq.URL.String(), req.URL.String())
+			require.Empty(t, req.Header)
+		})
+	}
+}
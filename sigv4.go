@@ -15,138 +15,1059 @@ package sigv4
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/textproto"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/endpoints"
-
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
-	signer "github.com/aws/aws-sdk-go/aws/signer/v4"
 )
 
 var sigv4HeaderDenylist = []string{
 	"uber-trace-id",
 }
 
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// sigV4Signer is implemented by RoundTrippers that sign requests with SigV4,
+// to detect signers being chained.
+type sigV4Signer interface {
+	signsSigV4() bool
+}
+
 type sigV4RoundTripper struct {
-	region string
-	next   http.RoundTripper
-	pool   sync.Pool
+	region  string
+	service string
+	next    http.RoundTripper
+	pool    sync.Pool
+	timeNow func() time.Time
+
+	signObserver func(req *http.Request, amzDate string)
+	metrics      *metrics
+	// regionHeader and serviceHeader are the request headers that override
+	// region and service, if set.
+	regionHeader  string
+	serviceHeader string
+
+	compressBody bool
+	// minCredentialValidity is the minimum time the signing credentials must
+	// remain valid for at signing time before they are refreshed.
+	minCredentialValidity time.Duration
+	// validityMtx guards the refreshes forced by minCredentialValidity.
+	// forcedExpiry is the expiry of the credentials last expired, and
+	// refreshPending is set until their replacement is seen. shortExpiry is
+	// that of a replacement that still didn't remain valid for long enough,
+	// which is used as is rather than refreshed again.
+	validityMtx               sync.Mutex
+	refreshPending            atomic.Bool
+	forcedExpiry, shortExpiry time.Time
+	// networkErrorRetries is the number of times a request is re-signed and
+	// retried after a transient connection error from next.
+	networkErrorRetries      int
+	networkErrorRetryBackoff time.Duration
+	// throttlingRetries is the number of times a request is re-signed and
+	// retried after a 429 response, waiting for as long as its Retry-After
+	// header asks for, up to maxRetryAfter unless maxRetryDuration is set.
+	throttlingRetries int
+	// signRetries is the number of times a request is re-signed with fresh
+	// credentials and retried after being rejected for an expired token,
+	// waiting signRetryBackoff in between. Zero means once.
+	signRetries      int
+	signRetryBackoff time.Duration
+	// maxRetryDuration, if positive, bounds the time spent retrying a request
+	// across all kinds of retries, after which the last error or response is
+	// returned.
+	maxRetryDuration time.Duration
+	// addDateHeader sets a standard HTTP Date header alongside X-Amz-Date,
+	// which is only included in the signature if signDateHeader is set.
+	addDateHeader  bool
+	signDateHeader bool
+	// newNonce, if set, generates the X-Amz-Nonce header signed with every
+	// attempt of a request, for backends with replay protection.
+	newNonce func() (string, error)
+	// userAgent, if set, replaces the User-Agent header of requests. It is
+	// only signed with signer.signUserAgent.
+	userAgent string
+	// signingHost overrides the Host the request is signed for and sent with,
+	// for when next doesn't connect to the AWS endpoint directly.
+	signingHost string
+	// followRegionHint re-signs and retries a request once for the region
+	// indicated by the X-Amz-Bucket-Region header of its error response.
+	followRegionHint bool
+	// defaultToHTTPS sends requests without a URL scheme over https.
+	defaultToHTTPS bool
+	// stripDefaultPort removes the default port of the scheme from the URL
+	// and Host of the request.
+	stripDefaultPort bool
+	// defaultContentType sets the Content-Type expected by the service on
+	// requests with a body that don't set one.
+	defaultContentType bool
+	// credentialsErrorCooldown is the time during which the error of a failed
+	// credential retrieval is returned instead of trying again.
+	credentialsErrorCooldown time.Duration
+	credsErrMtx              sync.Mutex
+	credsErr                 error
+	credsErrTime             time.Time
+	// lastCreds and lastCredsExpiry are the credentials last signed with, to
+	// count refreshes in metrics.
+	lastCredsMtx    sync.Mutex
+	lastCreds       credentials.Value
+	lastCredsExpiry time.Time
+	// signingTimeout bounds the time spent retrieving credentials and signing
+	// a request, without limiting the request sent to next.
+	signingTimeout time.Duration
+	// requireTLS refuses to sign requests that aren't sent over https, and to
+	// return redirects from https to another scheme.
+	requireTLS bool
+	// unsignedPayload signs requests without hashing their body, which is only
+	// allowed over plain HTTP if allowInsecureUnsignedPayload is set.
+	unsignedPayload              bool
+	allowInsecureUnsignedPayload bool
+	// maxSignedHeaders is the maximum number of headers of a request to sign,
+	// requests with more are rejected. Zero means no limit.
+	maxSignedHeaders int
+	// verifyContentSHA256 rejects requests whose X-Amz-Content-Sha256 header
+	// doesn't match the body, instead of sending them to be rejected by the
+	// service.
+	verifyContentSHA256 bool
+	// requireContentLength rejects requests with a body of unknown length,
+	// such as chunked ones, rather than buffering them whole to hash them.
+	requireContentLength bool
+	// softBodySizeWarn is the body size in bytes above which a warning is
+	// logged with logger. Zero means no warning.
+	softBodySizeWarn int
+	logger           *slog.Logger
+	// postSignMutationCheck attaches the signed request to the context of
+	// the request handed to next, for AssertNoPostSignMutation.
+	postSignMutationCheck bool
+
+	creds  *credentials.Credentials
+	signer v4Signer
 
-	signer *signer.Signer
+	// sess, roleChain, roleARN and assumeRoleOptions are used to assume the
+	// role with credentials passed in the request context. The role
+	// credentials are cached per source credentials in contextRoleCreds.
+	sess                *session.Session
+	roleChain           []string
+	roleARN             string
+	assumeRoleOptions   func(*stscreds.AssumeRoleProvider)
+	assumedRole         *assumedRoleRecorder
+	contextRoleCredsMtx sync.Mutex
+	contextRoleCreds    map[credentials.Value]*credentials.Credentials
 }
 
+// maxContextRoleCreds bounds the number of role credentials cached for
+// credentials passed in request contexts.
+const maxContextRoleCreds = 100
+
 // NewSigV4RoundTripper returns a new http.RoundTripper that will sign requests
 // using Amazon's Signature Verification V4 signing procedure. The request will
 // then be handed off to the next RoundTripper provided by next. If next is nil,
 // http.DefaultTransport will be used.
 //
 // Credentials for signing are retrieved using the the default AWS credential
-// chain. If credentials cannot be found, an error will be returned.
-func NewSigV4RoundTripper(cfg *SigV4Config, next http.RoundTripper) (http.RoundTripper, error) {
+// chain. If credentials cannot be found, an error will be returned, unless
+// their retrieval is deferred to the first request with WithLazyCredentials.
+// cfg is validated in any case. If anonymous is set in cfg, no credentials are
+// retrieved and requests are passed on without being signed.
+//
+// Requests are signed for the region and service set in cfg. If unset, they
+// are parsed from the endpoint set in cfg, if it is an AWS hostname. The
+// region otherwise falls back to the one of the default AWS credential chain,
+// and the service to "aps" (Amazon Managed Service for Prometheus). The
+// service is never inferred from the request host, so that requests sent
+// through proxies are scoped correctly. Requests are always sent to the URL
+// they were made for, so setting endpoint doesn't redirect them.
+//
+// Optional behavior can be configured by passing one or more Options.
+func NewSigV4RoundTripper(cfg *SigV4Config, next http.RoundTripper, opts ...Option) (http.RoundTripper, error) {
+	return NewSigV4RoundTripperContext(context.Background(), cfg, next, opts...)
+}
+
+// NewSigV4RoundTripperContext returns a new http.RoundTripper like
+// NewSigV4RoundTripper, but retrieves credentials with ctx, so that their
+// resolution can be bounded at startup, such as when the EC2 instance metadata
+// service is unreachable.
+func NewSigV4RoundTripperContext(ctx context.Context, cfg *SigV4Config, next http.RoundTripper, opts ...Option) (http.RoundTripper, error) {
 	if next == nil {
 		next = http.DefaultTransport
 	}
+	rt, err := newSigV4RoundTripperFromConfig(ctx, cfg, next, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
 
-	creds := credentials.NewStaticCredentials(cfg.AccessKey, string(cfg.SecretKey), "")
-	if cfg.AccessKey == "" && cfg.SecretKey == "" {
-		creds = nil
+func newSigV4RoundTripperFromConfig(ctx context.Context, cfg *SigV4Config, next http.RoundTripper, opts ...Option) (*sigV4RoundTripper, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
-	useFIPSSTSEndpoint := endpoints.FIPSEndpointStateDisabled
-	if cfg.UseFIPSSTSEndpoint {
-		useFIPSSTSEndpoint = endpoints.FIPSEndpointStateEnabled
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if s, ok := next.(sigV4Signer); o.rejectSignedNext && ok && s.signsSigV4() {
+		return nil, fmt.Errorf("next RoundTripper already signs requests with SigV4")
 	}
 
-	sess, err := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:          aws.String(cfg.Region),
-			Credentials:     creds,
-			UseFIPSEndpoint: useFIPSSTSEndpoint,
-		},
-		Profile: cfg.Profile,
-	})
+	service := cfg.Service
+	if service == "" && cfg.Endpoint != "" {
+		_, service = parseEndpoint(cfg.Endpoint)
+	}
+	if service == "" {
+		service = "aps"
+	}
+
+	if cfg.ClearEnvAfterLoad && o.lazyCredentials {
+		return nil, fmt.Errorf("clear_env_after_load can't be used with lazily retrieved credentials")
+	}
+	rc, err := resolveCredentials(ctx, cfg, &o)
 	if err != nil {
-		return nil, fmt.Errorf("could not create new AWS session: %w", err)
+		return nil, err
 	}
-	if _, err := sess.Config.Credentials.Get(); err != nil {
-		return nil, fmt.Errorf("could not get SigV4 credentials: %w", err)
+	sess, sourceCreds, roleARN := rc.sess, rc.source, rc.roleARN
+
+	if o.logger != nil {
+		source := sourceCreds.ProviderName
+		if o.lazyCredentials {
+			source = "unresolved"
+		}
+		o.logger.Info("Resolved SigV4 credentials",
+			"source", source,
+			"region", aws.StringValue(sess.Config.Region),
+			"partition", rc.partition,
+			"profile", cfg.Profile,
+			"role_arn", roleARN,
+		)
 	}
-	if aws.StringValue(sess.Config.Region) == "" {
-		return nil, fmt.Errorf("region not configured in sigv4 or in default credentials chain")
+
+	rt := newSigV4RoundTripper(aws.StringValue(sess.Config.Region), service, rc.creds, next)
+	if o.registerer != nil {
+		if rt.metrics, err = newMetrics(o.registerer, o.metricLabels); err != nil {
+			return nil, fmt.Errorf("could not register metrics: %w", err)
+		}
 	}
+	rt.signObserver = o.signObserver
+	rt.regionHeader = o.regionHeader
+	rt.serviceHeader = o.serviceHeader
+	rt.signer.transformCanonicalRequest = o.transformCanonicalRequest
+	rt.signer.signUserAgent = cfg.SignUserAgent
+	rt.signer.disablePathEscaping = cfg.DisablePathEscaping
+	if len(cfg.SignedHeaders) > 0 {
+		rt.signer.signedHeaders = make(map[string]struct{}, len(cfg.SignedHeaders))
+		for _, h := range cfg.SignedHeaders {
+			rt.signer.signedHeaders[http.CanonicalHeaderKey(h)] = struct{}{}
+		}
+	}
+	rt.signer.newHash = o.newHash
+	rt.signer.asymmetric = cfg.SigningAlgorithm == SigningAlgorithmSigV4A
+	rt.signer.regionSet = cfg.RegionSet
+	rt.compressBody = cfg.CompressBody
+	rt.minCredentialValidity = time.Duration(cfg.MinCredentialValidity)
+	rt.networkErrorRetries = cfg.RetryOnNetworkError
+	rt.networkErrorRetryBackoff = time.Duration(cfg.NetworkErrorRetryBackoff)
+	rt.throttlingRetries = cfg.RetryOnThrottling
+	rt.maxRetryDuration = time.Duration(cfg.MaxRetryDuration)
+	rt.signRetries = cfg.MaxSignRetries
+	rt.signRetryBackoff = time.Duration(cfg.SignRetryBackoff)
+	rt.addDateHeader = cfg.AddDateHeader
+	rt.signDateHeader = cfg.SignDateHeader
+	rt.signingHost = cfg.SigningHost
+	rt.userAgent = cfg.UserAgent
+	if cfg.AddNonceHeader {
+		rt.newNonce = o.newNonce
+		if rt.newNonce == nil {
+			rt.newNonce = randomNonce
+		}
+	}
+	rt.defaultToHTTPS = cfg.DefaultToHTTPS
+	rt.followRegionHint = cfg.FollowRegionHint
+	rt.stripDefaultPort = cfg.StripDefaultPort
+	rt.defaultContentType = cfg.DefaultContentType
+	rt.credentialsErrorCooldown = time.Duration(cfg.CredentialsErrorCooldown)
+	rt.signingTimeout = time.Duration(cfg.SigningTimeout)
+	rt.requireTLS = cfg.RequireTLS
+	rt.unsignedPayload = cfg.UnsignedPayload
+	rt.allowInsecureUnsignedPayload = cfg.AllowInsecureUnsignedPayload
+	rt.verifyContentSHA256 = cfg.VerifyContentSHA256
+	rt.maxSignedHeaders = cfg.MaxSignedHeaders
+	rt.softBodySizeWarn = cfg.SoftBodySizeWarn
+	rt.requireContentLength = cfg.RequireContentLength
+	rt.logger = o.logger
+	rt.postSignMutationCheck = o.postSignMutationCheck
+	rt.sess = rc.stsSess
+	// Roles assumed with a web identity don't take source credentials, so
+	// credentials passed in a request context are used as is.
+	if cfg.WebIdentityTokenFile == "" {
+		rt.roleChain = rc.roleChain
+		rt.roleARN = roleARN
+	}
+	rt.assumeRoleOptions = assumeRoleOptions(cfg, o.mfaTokenProvider)
+	rt.assumedRole = rc.assumedRole
+
+	return rt, nil
+}
+
+// NewStaticSigV4RoundTripper returns a new http.RoundTripper that signs
+// requests for the given region and service with the given static
+// credentials. Unlike NewSigV4RoundTripper, no configuration files or
+// environment variables are consulted. If service is empty, "aps" is used. If
+// next is nil, http.DefaultTransport will be used.
+func NewStaticSigV4RoundTripper(accessKey, secretKey, token, region, service string, next http.RoundTripper) (http.RoundTripper, error) {
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("must provide an AWS SigV4 access key and secret key")
+	}
+	return NewSigV4RoundTripperWithCredentials(region, service, &credentials.StaticProvider{Value: credentials.Value{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		SessionToken:    token,
+	}}, next)
+}
 
-	signerCreds := sess.Config.Credentials
-	if cfg.RoleARN != "" {
-		signerCreds = stscreds.NewCredentials(sess, cfg.RoleARN)
+// NewSigV4RoundTripperWithCredentials returns a new http.RoundTripper that
+// signs requests for the given region and service with credentials retrieved
+// from provider, such as one managed outside of the AWS SDK. Credentials are
+// cached until provider reports them as expired. Like for
+// NewStaticSigV4RoundTripper, no configuration files or environment variables
+// are consulted. If service is empty, "aps" is used. If next is nil,
+// http.DefaultTransport will be used.
+func NewSigV4RoundTripperWithCredentials(region, service string, provider credentials.Provider, next http.RoundTripper) (http.RoundTripper, error) {
+	if provider == nil {
+		return nil, fmt.Errorf("must provide an AWS credentials provider")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("must provide an AWS region")
+	}
+	if service == "" {
+		service = "aps"
+	}
+	if next == nil {
+		next = http.DefaultTransport
 	}
+	return newSigV4RoundTripper(region, service, credentials.NewCredentials(provider), next), nil
+}
 
+func newSigV4RoundTripper(region, service string, creds *credentials.Credentials, next http.RoundTripper) *sigV4RoundTripper {
 	rt := &sigV4RoundTripper{
-		region: cfg.Region,
-		next:   next,
-		signer: signer.NewSigner(signerCreds),
+		region:  region,
+		service: service,
+		next:    next,
+		timeNow: time.Now,
+		creds:   creds,
 	}
 	rt.pool.New = rt.newBuf
-	return rt, nil
+	return rt
 }
 
+func (rt *sigV4RoundTripper) signsSigV4() bool { return true }
+
 func (rt *sigV4RoundTripper) newBuf() interface{} {
 	return bytes.NewBuffer(make([]byte, 0, 1024))
 }
 
 func (rt *sigV4RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	// rt.signer.Sign needs a seekable body, so we replace the body with a
-	// buffered reader filled with the contents of original body.
-	buf := rt.pool.Get().(*bytes.Buffer)
-	defer func() {
-		buf.Reset()
-		rt.pool.Put(buf)
-	}()
-
-	if req.Body != nil {
-		if _, err := io.Copy(buf, req.Body); err != nil {
+	// Don't bother retrieving credentials and signing a request that can't be
+	// sent anymore.
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	// The routing headers are stripped from the request that is sent, which
+	// mustn't affect the caller's request, such as when an http.Client sends it
+	// again to follow a redirect.
+	if rt.regionHeader != "" || rt.serviceHeader != "" {
+		req = req.Clone(req.Context())
+	}
+	p, release, err := rt.prepare(req, false)
+	defer release()
+	if err != nil {
+		return nil, err
+	}
+	region := p.region
+
+	// GetBody allows next to replay the body on its own retries, such as
+	// after a reused keep-alive connection was closed by the server. A body
+	// that was passed through can only be replayed if the caller allows it.
+	body := p.body
+	if !p.passthrough {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	var networkErrorRetries, throttlingRetries, regionRetries, expiredTokenRetries int
+	start := rt.timeNow()
+	// canRetry reports whether the body can be replayed, and a retry after
+	// delay still ends within max_retry_duration of the first attempt.
+	canRetry := func(delay time.Duration) bool {
+		if req.GetBody == nil && req.Body != nil && req.Body != http.NoBody {
+			return false
+		}
+		return rt.maxRetryDuration <= 0 || rt.timeNow().Add(delay).Sub(start) <= rt.maxRetryDuration
+	}
+	for attempt := 0; ; attempt++ {
+		if req.GetBody != nil && (attempt > 0 || !p.passthrough) {
+			req.Body, _ = req.GetBody()
+		}
+		signed, err := rt.sign(req.Context(), req, p.payloadHash, p.service, region)
+		if err != nil {
 			return nil, err
 		}
+
+		resp, err := rt.next.RoundTrip(signed)
+		if err != nil {
+			if networkErrorRetries >= rt.networkErrorRetries || !isNetworkError(err) || !canRetry(rt.networkErrorRetryBackoff) {
+				return nil, err
+			}
+			networkErrorRetries++
+			if err := sleepContext(req.Context(), rt.networkErrorRetryBackoff); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if rt.requireTLS && isDowngradeRedirect(req, resp) {
+			drainAndClose(resp.Body)
+			return nil, fmt.Errorf("refusing redirect from https to %s, require_tls is enabled", resp.Header.Get("Location"))
+		}
+
+		if delay := retryAfter(resp, rt.timeNow()); resp.StatusCode == http.StatusTooManyRequests && throttlingRetries < rt.throttlingRetries &&
+			(rt.maxRetryDuration > 0 || delay <= maxRetryAfter) && canRetry(delay) {
+			throttlingRetries++
+			drainAndClose(resp.Body)
+			if err := sleepContext(req.Context(), delay); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if hint := regionHint(resp); rt.followRegionHint && regionRetries < 1 && hint != "" && hint != region && canRetry(0) {
+			// The resource lives in another region than the request was
+			// signed for, as is common with misconfigured S3 buckets.
+			regionRetries++
+			region = hint
+			drainAndClose(resp.Body)
+			continue
+		}
+
+		retried := networkErrorRetries+throttlingRetries+regionRetries+expiredTokenRetries > 0
+		if expiredTokenRetries >= max(rt.signRetries, 1) || !canRetry(rt.signRetryBackoff) {
+			rt.metrics.observeResponse(req.Context(), resp, retried)
+			return resp, nil
+		}
+		expired, err := isExpiredTokenResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+		if !expired {
+			rt.metrics.observeResponse(req.Context(), resp, retried)
+			return resp, nil
+		}
+		// The credentials expired while the request was in flight. Refresh
+		// them and sign the request again.
+		_ = resp.Body.Close()
+		expiredTokenRetries++
+		rt.metrics.observeExpiredTokenRetry()
+		rt.creds.Expire()
+		if err := sleepContext(req.Context(), rt.signRetryBackoff); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// preparedRequest is a request whose body has been buffered, ready to be
+// signed.
+type preparedRequest struct {
+	body        []byte
+	payloadHash string
+	service     string
+	region      string
+	// passthrough is set if the body wasn't buffered, as it isn't needed to
+	// sign the request, and is sent as is.
+	passthrough bool
+}
+
+// prepare buffers the body of req and normalizes req for signing. The returned
+// body may be kept after release, which returns the buffers of the pool the
+// body was compressed from, and must happen even if an error is returned. For
+// presigning, the body isn't compressed and no headers are added, as the
+// request is sent by someone else with the headers it was made with.
+func (rt *sigV4RoundTripper) prepare(req *http.Request, presign bool) (_ preparedRequest, release func(), _ error) {
+	var bufs []*bytes.Buffer
+	release = func() {
+		for _, buf := range bufs {
+			buf.Reset()
+			rt.pool.Put(buf)
+		}
+	}
+
+	if req.URL.Scheme == "" {
+		if !rt.defaultToHTTPS {
+			return preparedRequest{}, release, fmt.Errorf("request URL %s has no scheme, set one or enable default_to_https", req.URL)
+		}
+		req.URL.Scheme = "https"
+	}
+
+	if rt.requireTLS && req.URL.Scheme != "https" {
+		return preparedRequest{}, release, fmt.Errorf("refusing to sign request over %s, require_tls is enabled", req.URL.Scheme)
+	}
+
+	// Without a signed payload, the body could be tampered with in transit
+	// unless the connection is protected by TLS.
+	if rt.unsignedPayload && req.URL.Scheme != "https" && !rt.allowInsecureUnsignedPayload {
+		return preparedRequest{}, release, fmt.Errorf("refusing to send request with unsigned payload over %s, use https or enable allow_insecure_unsigned_payload", req.URL.Scheme)
+	}
+
+	// With an unsigned payload, the body is only needed to compress it or
+	// verify its X-Amz-Content-Sha256 header. Otherwise, it is left untouched
+	// so that large bodies aren't held in memory.
+	passthrough := rt.unsignedPayload && !rt.compressBody && !rt.verifyContentSHA256
+
+	// The payload hash is computed over the whole body, so we replace the body
+	// with a buffered reader filled with the contents of original body. The
+	// body that is sent is kept by GetBody after the request, so it is read
+	// into a buffer of its own, unless it is only read to be compressed.
+	compress := rt.compressBody && !presign && req.Header.Get("Content-Encoding") == ""
+	buf := new(bytes.Buffer)
+	if compress {
+		buf = rt.pool.Get().(*bytes.Buffer)
+		bufs = append(bufs, buf)
+	}
+
+	if req.Body != nil && !passthrough {
+		// Bodies that know their length, such as bytes.Buffer, are read into a
+		// buffer large enough to hold them at once.
+		if l, ok := req.Body.(interface{ Len() int }); ok {
+			n := l.Len()
+			if compress {
+				buf.Grow(n + bytes.MinRead)
+			} else {
+				buf = bytes.NewBuffer(make([]byte, 0, n+bytes.MinRead))
+			}
+			if req.ContentLength <= 0 {
+				req.ContentLength = int64(n)
+			}
+		}
+		if rt.requireContentLength && !rt.unsignedPayload && req.ContentLength <= 0 && req.Body != http.NoBody {
+			return preparedRequest{}, release, fmt.Errorf("request body of unknown length would have to be buffered to be signed, set its Content-Length or enable unsigned_payload")
+		}
+		if _, err := io.Copy(buf, req.Body); err != nil {
+			return preparedRequest{}, release, err
+		}
 		// Close the original body since we don't need it anymore.
 		_ = req.Body.Close()
 	}
 
-	// Ensure our seeker is back at the start of the buffer once we return.
-	var seeker io.ReadSeeker = bytes.NewReader(buf.Bytes())
-	defer func() {
-		_, _ = seeker.Seek(0, io.SeekStart)
-	}()
-	req.Body = io.NopCloser(seeker)
+	body := buf.Bytes()
+	hasBody, size := len(body) > 0, int64(len(body))
+	if passthrough {
+		hasBody, size = req.Body != nil && req.Body != http.NoBody, req.ContentLength
+	}
+	// Large bodies are often a sign of misconfigured batching, which is worth
+	// knowing about before requests get rejected for their size.
+	if rt.softBodySizeWarn > 0 && size > int64(rt.softBodySizeWarn) && rt.logger != nil {
+		rt.logger.Warn("Request body exceeds soft_body_size_warn",
+			"size", size,
+			"soft_body_size_warn", rt.softBodySizeWarn,
+			"url", req.URL.Redacted(),
+		)
+	}
+	if compress && len(body) > 0 {
+		zbuf := new(bytes.Buffer)
+		if err := gzipBody(zbuf, body); err != nil {
+			return preparedRequest{}, release, fmt.Errorf("failed to compress request body: %w", err)
+		}
+		body = zbuf.Bytes()
+
+		req.Header.Set("Content-Encoding", "gzip")
+		req.ContentLength = int64(len(body))
+		if req.Header.Get("Content-Length") != "" {
+			req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+	}
 
 	// Clean path like documented in AWS documentation.
 	// https://docs.aws.amazon.com/general/latest/gr/sigv4-create-canonical-request.html
-	req.URL.Path = path.Clean(req.URL.Path)
+	// An empty path is left as is, it is signed as "/". Paths signed without
+	// escaping are sent exactly as they are signed.
+	if req.URL.Path != "" && !rt.signer.disablePathEscaping {
+		req.URL.Path = path.Clean(req.URL.Path)
+	}
+	// Spaces are signed as %20, so send them that way rather than as the + of
+	// form encoding, which the service would otherwise canonicalize as is.
+	if strings.Contains(req.URL.RawQuery, "+") {
+		req.URL.RawQuery = strings.ReplaceAll(req.URL.RawQuery, "+", "%20")
+	}
+
+	if rt.stripDefaultPort {
+		req.URL.Host = stripDefaultPort(req.URL.Host, req.URL.Scheme)
+		req.Host = stripDefaultPort(req.Host, req.URL.Scheme)
+	}
+	if rt.signingHost != "" {
+		req.Host = rt.signingHost
+	}
+	service := rt.service
+	if rt.serviceHeader != "" {
+		if s := req.Header.Get(rt.serviceHeader); s != "" {
+			service = s
+		}
+		req.Header.Del(rt.serviceHeader)
+	}
+	if contentType := serviceDefaults(service).ContentType; rt.defaultContentType && !presign && contentType != "" &&
+		hasBody && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	region := rt.region
+	if rt.regionHeader != "" {
+		if r := req.Header.Get(rt.regionHeader); r != "" {
+			region = r
+		}
+		req.Header.Del(rt.regionHeader)
+	}
+	if r := serviceDefaults(service).GlobalRegion; r != "" {
+		region = r
+	}
+
+	// Merge header keys differing only in case so that repeated headers are
+	// signed as a single comma-joined value.
+	mergeHeaderKeys(req.Header)
+	if n := rt.signer.countSignedHeaders(req); rt.maxSignedHeaders > 0 && n > rt.maxSignedHeaders {
+		return preparedRequest{}, release, fmt.Errorf("request has %d headers to sign, more than the maximum of %d", n, rt.maxSignedHeaders)
+	}
+
+	payloadHash := unsignedPayload
+	if !rt.unsignedPayload {
+		payloadHash = rt.signer.hash(body)
+	}
+	if h := req.Header.Get("X-Amz-Content-Sha256"); rt.verifyContentSHA256 && isPayloadHash(h) && h != rt.signer.hash(body) {
+		return preparedRequest{}, release, fmt.Errorf("X-Amz-Content-Sha256 header %s doesn't match the SHA256 of the request body", h)
+	}
+	return preparedRequest{body: body, payloadHash: payloadHash, service: service, region: region, passthrough: passthrough}, release, nil
+}
+
+// isPayloadHash reports whether the X-Amz-Content-Sha256 header value h is the
+// hash of the payload, rather than empty or a placeholder such as
+// UNSIGNED-PAYLOAD.
+func isPayloadHash(h string) bool {
+	return h != "" && h != unsignedPayload && !strings.HasPrefix(h, "STREAMING-")
+}
+
+// maxErrorResponseInspectSize is the maximum number of bytes of an error
+// response body read to detect errors the request is retried on.
+const maxErrorResponseInspectSize = 64 << 10
+
+// isExpiredTokenResponse reports whether resp was rejected because the
+// session token used to sign the request has expired. At most
+// maxErrorResponseInspectSize bytes of the response body are read; the body is
+// replaced so that it can still be read in full by the caller.
+func isExpiredTokenResponse(resp *http.Response) (bool, error) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusBadRequest || resp.Body == nil {
+		return false, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorResponseInspectSize))
+	if err != nil {
+		_ = resp.Body.Close()
+		return false, fmt.Errorf("failed to read error response: %w", err)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+
+	// Depending on the protocol of the service the error code is either
+	// ExpiredToken or ExpiredTokenException.
+	return bytes.Contains(data, []byte("ExpiredToken")), nil
+}
 
-	// Clone the request and trim out headers that we don't want to sign.
-	signReq := req.Clone(req.Context())
+// isDowngradeRedirect reports whether resp redirects the https request req to
+// a URL that isn't https.
+func isDowngradeRedirect(req *http.Request, resp *http.Response) bool {
+	if req.URL.Scheme != "https" || resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return false
+	}
+	loc, err := resp.Location()
+	return err == nil && loc.Scheme != "https"
+}
+
+// regionHint returns the region resp indicates the request should have been
+// signed for, if it was rejected for being signed for the wrong one.
+func regionHint(resp *http.Response) string {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusBadRequest, http.StatusForbidden:
+		return resp.Header.Get("X-Amz-Bucket-Region")
+	}
+	return ""
+}
+
+// sign signs req for a body with the given payload hash, service and region,
+// retrieving credentials with ctx. The signature headers are set on req
+// directly. The returned request is the one to send, which with
+// postSignMutationCheck is a copy of req carrying the request as signed.
+func (rt *sigV4RoundTripper) sign(ctx context.Context, req *http.Request, payloadHash, service, region string) (*http.Request, error) {
+	if rt.userAgent != "" {
+		req.Header.Set("User-Agent", rt.userAgent)
+	}
+	// Anonymous requests are sent as is, like the AWS SDK does.
+	if rt.creds == credentials.AnonymousCredentials {
+		return req, nil
+	}
+	start := time.Now()
+
+	signTime := rt.timeNow().UTC()
+	if rt.addDateHeader {
+		req.Header.Set("Date", signTime.Format(http.TimeFormat))
+	}
+	if rt.newNonce != nil {
+		nonce, err := rt.newNonce()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		req.Header.Set("X-Amz-Nonce", nonce)
+	}
+
+	// Clone the request and trim out headers that we don't want to sign,
+	// including the signature of a previous attempt.
+	signReq := req.Clone(ctx)
+	signReq.Header.Del("Authorization")
 	for _, header := range sigv4HeaderDenylist {
-		signReq.Header.Del(header)
+		if !rt.signer.isSignedHeader(header) {
+			signReq.Header.Del(header)
+		}
+	}
+	if rt.addDateHeader && !rt.signDateHeader {
+		signReq.Header.Del("Date")
 	}
 
-	headers, err := rt.signer.Sign(signReq, seeker, "aps", rt.region, time.Now().UTC())
+	if rt.signingTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rt.signingTimeout)
+		defer cancel()
+	}
+	creds, err := rt.retrieveCredentials(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign request: %w", err)
 	}
 
-	// Copy over signed headers. Authorization header is not returned by
-	// rt.signer.Sign and needs to be copied separately.
+	// Copy over the headers added by signing.
+	headers, err := rt.signer.sign(signReq, payloadHash, creds, service, region, signTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign request: %w", err)
+	}
 	for k, v := range headers {
-		req.Header[textproto.CanonicalMIMEHeaderKey(k)] = v
+		req.Header[k] = v
+	}
+	rt.metrics.observeSign(time.Since(start))
+
+	if rt.signObserver != nil {
+		rt.signObserver(req, req.Header.Get("X-Amz-Date"))
+	}
+	if rt.postSignMutationCheck {
+		return withSignedRequest(req, signReq), nil
+	}
+	return req, nil
+}
+
+// randomNonce returns 16 random bytes, hex encoded.
+func randomNonce() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// isNetworkError reports whether err is a transient connection error that is
+// safe to retry the request on.
+func isNetworkError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// defaultRetryAfter is the time waited before retrying a throttled request
+// whose response has no valid Retry-After header.
+const defaultRetryAfter = time.Second
+
+// maxRetryAfter is the longest Retry-After a throttled request is retried
+// after if max_retry_duration isn't set. Throttled responses asking for longer
+// are returned, rather than holding the request for up to days.
+const maxRetryAfter = time.Minute
+
+// retryAfter returns the time to wait before retrying the request resp is a
+// response to, as given in either seconds or as a date by the Retry-After
+// header.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	h := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(h); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return t.Sub(now)
+	}
+	return defaultRetryAfter
+}
+
+// drainAndClose reads up to maxErrorResponseInspectSize bytes of body before
+// closing it, so that small responses don't prevent the connection from being
+// reused.
+func drainAndClose(body io.ReadCloser) {
+	if body == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, maxErrorResponseInspectSize))
+	_ = body.Close()
+}
+
+// sleepContext waits for d to elapse or ctx to be done, whichever happens
+// first. The context error is returned if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
 	}
-	req.Header.Set("Authorization", signReq.Header.Get("Authorization"))
+}
+
+// retrieveCredentials returns the credentials to sign requests with. After a
+// failure to retrieve them, the error is returned without attempting another
+// retrieval until credentialsErrorCooldown has passed.
+func (rt *sigV4RoundTripper) retrieveCredentials(ctx context.Context) (credentials.Value, error) {
+	if creds, ok := credentialsFromContext(ctx); ok {
+		if rt.roleARN == "" {
+			return creds, nil
+		}
+		creds, err := rt.contextRoleCredentials(creds).GetWithContext(ctx)
+		return creds, contextError(ctx, err)
+	}
+
+	if rt.credentialsErrorCooldown > 0 {
+		rt.credsErrMtx.Lock()
+		err, retryAt := rt.credsErr, rt.credsErrTime.Add(rt.credentialsErrorCooldown)
+		rt.credsErrMtx.Unlock()
+
+		if err != nil && rt.timeNow().Before(retryAt) {
+			return credentials.Value{}, fmt.Errorf("not retrieving credentials until %s after previous failure: %w", retryAt.Format(time.RFC3339), err)
+		}
+	}
+
+	rt.ensureCredentialValidity()
+
+	creds, err := rt.creds.GetWithContext(ctx)
+	if err == nil && rt.metrics != nil {
+		rt.observeCredentials(creds)
+	}
+	if err != nil && ctx.Err() != nil {
+		// The request gave up on the credentials, which says nothing about
+		// whether they can be retrieved.
+		return creds, ctx.Err()
+	}
+	if rt.credentialsErrorCooldown > 0 {
+		rt.credsErrMtx.Lock()
+		rt.credsErr, rt.credsErrTime = err, rt.timeNow()
+		rt.credsErrMtx.Unlock()
+	}
+	return creds, err
+}
+
+// observeCredentials counts a credential refresh if creds or their expiry
+// differ from the ones last signed with.
+func (rt *sigV4RoundTripper) observeCredentials(creds credentials.Value) {
+	// Credentials that don't expire have no expiry to compare.
+	expiresAt, _ := rt.creds.ExpiresAt()
 
-	return rt.next.RoundTrip(req)
+	rt.lastCredsMtx.Lock()
+	defer rt.lastCredsMtx.Unlock()
+	if creds == rt.lastCreds && expiresAt.Equal(rt.lastCredsExpiry) {
+		return
+	}
+	rt.lastCreds, rt.lastCredsExpiry = creds, expiresAt
+	rt.metrics.observeCredentialRefresh()
+}
+
+// contextError returns the error of ctx in place of err if ctx is done, as the
+// errors of the AWS SDK for canceled contexts don't wrap them.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// contextRoleCredentials returns the credentials of the configured role
+// assumed with the source credentials passed in a request context.
+func (rt *sigV4RoundTripper) contextRoleCredentials(source credentials.Value) *credentials.Credentials {
+	rt.contextRoleCredsMtx.Lock()
+	defer rt.contextRoleCredsMtx.Unlock()
+
+	if creds, ok := rt.contextRoleCreds[source]; ok {
+		return creds
+	}
+	if rt.contextRoleCreds == nil || len(rt.contextRoleCreds) >= maxContextRoleCreds {
+		rt.contextRoleCreds = make(map[credentials.Value]*credentials.Credentials)
+	}
+	sess := rt.sess.Copy(&aws.Config{Credentials: credentials.NewStaticCredentialsFromCreds(source)})
+	sess = chainedRoleSession(sess, rt.roleChain, rt.assumeRoleOptions)
+	creds := stscreds.NewCredentials(sess, rt.roleARN, chainedRoleOptions(rt.assumeRoleOptions, len(rt.roleChain)))
+	rt.contextRoleCreds[source] = creds
+	return creds
+}
+
+// assumeRoleOptions returns a function configuring how the role of cfg is
+// assumed. Credentials are refreshed credentials_refresh_window before they
+// actually expire. If mfa_serial is set, MFA codes are read from
+// tokenProvider.
+func assumeRoleOptions(cfg *SigV4Config, tokenProvider func() (string, error)) func(*stscreds.AssumeRoleProvider) {
+	return func(p *stscreds.AssumeRoleProvider) {
+		if cfg.MFASerial != "" {
+			p.SerialNumber = aws.String(cfg.MFASerial)
+			p.TokenProvider = tokenProvider
+		}
+		p.ExpiryWindow = time.Duration(cfg.CredentialsRefreshWindow)
+		if cfg.RoleSessionName != "" {
+			p.RoleSessionName = cfg.RoleSessionName
+		}
+		if cfg.SessionDuration > 0 {
+			p.Duration = time.Duration(cfg.SessionDuration)
+		}
+	}
+}
+
+// chainedRoleSession returns a copy of sess with the credentials of the last
+// of roles, each assumed with the credentials of the previous one, starting
+// with those of sess.
+func chainedRoleSession(sess *session.Session, roles []string, opts func(*stscreds.AssumeRoleProvider)) *session.Session {
+	for i, roleARN := range roles {
+		creds := stscreds.NewCredentials(sess, roleARN, chainedRoleOptions(opts, i))
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+	return sess
+}
+
+// chainedRoleOptions returns opts for the role at position step of a role
+// chain. MFA only applies to the first role, as the MFA device belongs to the
+// source identity.
+func chainedRoleOptions(opts func(*stscreds.AssumeRoleProvider), step int) func(*stscreds.AssumeRoleProvider) {
+	if step == 0 {
+		return opts
+	}
+	return func(p *stscreds.AssumeRoleProvider) {
+		opts(p)
+		p.SerialNumber = nil
+		p.TokenProvider = nil
+	}
+}
+
+// ensureCredentialValidity expires the signing credentials if they are about
+// to expire within minCredentialValidity, so that they are refreshed before
+// being used. Credentials that don't report an expiry are left untouched, and
+// each set of credentials is refreshed at most once, as the provider may not
+// issue credentials that remain valid for long enough.
+func (rt *sigV4RoundTripper) ensureCredentialValidity() {
+	if rt.minCredentialValidity <= 0 {
+		return
+	}
+	expiresAt, err := rt.creds.ExpiresAt()
+	if err != nil {
+		return
+	}
+	valid := expiresAt.Sub(rt.timeNow()) >= rt.minCredentialValidity
+	if valid && !rt.refreshPending.Load() {
+		return
+	}
+
+	rt.validityMtx.Lock()
+	defer rt.validityMtx.Unlock()
+	switch {
+	case rt.refreshPending.Load() && !expiresAt.Equal(rt.forcedExpiry):
+		// These credentials replaced those expired below.
+		rt.refreshPending.Store(false)
+		if !valid {
+			rt.shortExpiry = expiresAt
+			if rt.logger != nil {
+				rt.logger.Warn("Refreshed credentials expire within min_credential_validity, using them as is",
+					"expires_at", expiresAt,
+					"min_credential_validity", rt.minCredentialValidity,
+				)
+			}
+		}
+		return
+	case valid, rt.refreshPending.Load(), expiresAt.Equal(rt.shortExpiry):
+		return
+	}
+	rt.forcedExpiry = expiresAt
+	rt.refreshPending.Store(true)
+	rt.creds.Expire()
+}
+
+// gzipBody writes the gzip compressed form of body to dst.
+func gzipBody(dst *bytes.Buffer, body []byte) error {
+	zw := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(zw)
+
+	zw.Reset(dst)
+	if _, err := zw.Write(body); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// mergeHeaderKeys folds header keys that only differ in case into their
+// canonical form. Values are appended in sorted key order, which is the order
+// net/http writes them on the wire, so that the signed value matches the one
+// the server reconstructs.
+func mergeHeaderKeys(h http.Header) {
+	keys := make([]string, 0, len(h))
+	merge := false
+	for k := range h {
+		keys = append(keys, k)
+		merge = merge || k != textproto.CanonicalMIMEHeaderKey(k)
+	}
+	if !merge {
+		return
+	}
+	sort.Strings(keys)
+
+	merged := make(http.Header, len(h))
+	for _, k := range keys {
+		ck := textproto.CanonicalMIMEHeaderKey(k)
+		merged[ck] = append(merged[ck], h[k]...)
+		delete(h, k)
+	}
+	for k, v := range merged {
+		h[k] = v
+	}
 }
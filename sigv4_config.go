@@ -14,35 +14,283 @@
 package sigv4
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// ErrMissingKeys is returned by SigV4Config.Validate if only one of
+	// access_key and secret_key is set.
+	ErrMissingKeys = errors.New("must provide a AWS SigV4 Access key and Secret Key if credentials are specified in the SigV4 config")
+	// ErrRoleSettingWithoutRole is returned by SigV4Config.Validate for
+	// settings of assumed roles, such as role_session_name, when no role is
+	// set.
+	ErrRoleSettingWithoutRole = errors.New("requires role_arn, role_arn_chain or role_profile to be set")
 )
 
 // SigV4Config is the configuration for signing remote write requests with
 // AWS's SigV4 verification process. Empty values will be retrieved using the
 // AWS default credentials chain.
 type SigV4Config struct {
-	Region             string        `yaml:"region,omitempty"`
-	AccessKey          string        `yaml:"access_key,omitempty"`
-	SecretKey          config.Secret `yaml:"secret_key,omitempty"`
-	Profile            string        `yaml:"profile,omitempty"`
-	RoleARN            string        `yaml:"role_arn,omitempty"`
-	UseFIPSSTSEndpoint bool          `yaml:"use_fips_sts_endpoint,omitempty"`
+	Region                       string         `yaml:"region,omitempty"`
+	Service                      string         `yaml:"service,omitempty"`
+	Endpoint                     string         `yaml:"endpoint,omitempty"`
+	AccessKey                    string         `yaml:"access_key,omitempty"`
+	SecretKey                    config.Secret  `yaml:"secret_key,omitempty"`
+	Anonymous                    bool           `yaml:"anonymous,omitempty"`
+	ClearEnvAfterLoad            bool           `yaml:"clear_env_after_load,omitempty"`
+	Profile                      string         `yaml:"profile,omitempty"`
+	SharedCredentialsFile        string         `yaml:"shared_credentials_file,omitempty"`
+	SharedConfigFile             string         `yaml:"shared_config_file,omitempty"`
+	RoleProfile                  string         `yaml:"role_profile,omitempty"`
+	RoleARN                      string         `yaml:"role_arn,omitempty"`
+	RoleARNChain                 []string       `yaml:"role_arn_chain,omitempty"`
+	RoleSessionName              string         `yaml:"role_session_name,omitempty"`
+	SessionDuration              model.Duration `yaml:"session_duration,omitempty"`
+	MFASerial                    string         `yaml:"mfa_serial,omitempty"`
+	WebIdentityTokenFile         string         `yaml:"web_identity_token_file,omitempty"`
+	AssumeRoleRegion             string         `yaml:"assume_role_region,omitempty"`
+	STSEndpoint                  string         `yaml:"sts_endpoint,omitempty"`
+	UseFIPSSTSEndpoint           bool           `yaml:"use_fips_sts_endpoint,omitempty"`
+	UseFIPSEndpoint              bool           `yaml:"use_fips_endpoint,omitempty"`
+	UseDualStackEndpoint         bool           `yaml:"use_dualstack_endpoint,omitempty"`
+	EC2MetadataEndpoint          string         `yaml:"ec2_metadata_endpoint,omitempty"`
+	EC2MetadataEndpointMode      string         `yaml:"ec2_metadata_endpoint_mode,omitempty"`
+	CompressBody                 bool           `yaml:"compress_body,omitempty"`
+	MinCredentialValidity        model.Duration `yaml:"min_credential_validity,omitempty"`
+	CredentialsRefreshWindow     model.Duration `yaml:"credentials_refresh_window,omitempty"` // Only for assumed roles, see MinCredentialValidity otherwise.
+	CredentialsErrorCooldown     model.Duration `yaml:"credentials_error_cooldown,omitempty"`
+	VerifyCredentials            bool           `yaml:"verify_credentials,omitempty"`
+	SigningTimeout               model.Duration `yaml:"signing_timeout,omitempty"`
+	RetryOnNetworkError          int            `yaml:"retry_on_network_error,omitempty"`
+	NetworkErrorRetryBackoff     model.Duration `yaml:"network_error_retry_backoff,omitempty"`
+	RetryOnThrottling            int            `yaml:"retry_on_throttling,omitempty"`
+	MaxSignRetries               int            `yaml:"max_sign_retries,omitempty"`
+	SignRetryBackoff             model.Duration `yaml:"sign_retry_backoff,omitempty"`
+	MaxRetryDuration             model.Duration `yaml:"max_retry_duration,omitempty"`
+	FollowRegionHint             bool           `yaml:"follow_region_hint,omitempty"`
+	AddDateHeader                bool           `yaml:"add_date_header,omitempty"`
+	SignDateHeader               bool           `yaml:"sign_date_header,omitempty"`
+	SigningHost                  string         `yaml:"signing_host,omitempty"`
+	StripDefaultPort             bool           `yaml:"strip_default_port,omitempty"`
+	DisablePathEscaping          bool           `yaml:"disable_path_escaping,omitempty"`
+	DefaultToHTTPS               bool           `yaml:"default_to_https,omitempty"`
+	UserAgent                    string         `yaml:"user_agent,omitempty"`
+	SignUserAgent                bool           `yaml:"sign_user_agent,omitempty"`
+	SignedHeaders                []string       `yaml:"signed_headers,omitempty"`
+	AddNonceHeader               bool           `yaml:"add_nonce_header,omitempty"`
+	DefaultContentType           bool           `yaml:"default_content_type,omitempty"`
+	RequireTLS                   bool           `yaml:"require_tls,omitempty"`
+	UnsignedPayload              bool           `yaml:"unsigned_payload,omitempty"`
+	AllowInsecureUnsignedPayload bool           `yaml:"allow_insecure_unsigned_payload,omitempty"`
+	VerifyContentSHA256          bool           `yaml:"verify_content_sha256,omitempty"`
+	RequireContentLength         bool           `yaml:"require_content_length,omitempty"`
+	MaxSignedHeaders             int            `yaml:"max_signed_headers,omitempty"`
+	SigningAlgorithm             string         `yaml:"signing_algorithm,omitempty"`
+	RegionSet                    []string       `yaml:"region_set,omitempty"`
+	SoftBodySizeWarn             int            `yaml:"soft_body_size_warn,omitempty"`
 }
 
+// Validate checks c for invalid or conflicting settings. It is called when
+// unmarshaling c from YAML, and should be called by callers building c in
+// code. Errors for some checks wrap sentinel errors such as ErrMissingKeys.
 func (c *SigV4Config) Validate() error {
 	if (c.AccessKey == "") != (c.SecretKey == "") {
-		return fmt.Errorf("must provide a AWS SigV4 Access key and Secret Key if credentials are specified in the SigV4 config")
+		return ErrMissingKeys
+	}
+	if c.AccessKey != "" && (c.SharedCredentialsFile != "" || c.SharedConfigFile != "") {
+		return fmt.Errorf("shared_credentials_file and shared_config_file can't be used with access_key and secret_key")
+	}
+	if c.RoleProfile != "" {
+		if c.Profile == "" {
+			return fmt.Errorf("role_profile requires profile to be set as the source profile")
+		}
+		if c.RoleARN != "" {
+			return fmt.Errorf("role_profile and role_arn are mutually exclusive")
+		}
+	}
+	if len(c.RoleARNChain) > 0 {
+		if c.RoleARN != "" || c.RoleProfile != "" {
+			return fmt.Errorf("role_arn_chain can't be used with role_arn or role_profile")
+		}
+		for _, roleARN := range c.RoleARNChain {
+			if _, err := arn.Parse(roleARN); err != nil {
+				return fmt.Errorf("role_arn_chain must only contain ARNs, got %q", roleARN)
+			}
+		}
+	}
+	if c.RoleARN == "" && c.RoleProfile == "" && len(c.RoleARNChain) == 0 {
+		if c.RoleSessionName != "" {
+			return fmt.Errorf("role_session_name %w", ErrRoleSettingWithoutRole)
+		}
+		if c.SessionDuration != 0 {
+			return fmt.Errorf("session_duration %w", ErrRoleSettingWithoutRole)
+		}
+		if c.MFASerial != "" {
+			return fmt.Errorf("mfa_serial %w", ErrRoleSettingWithoutRole)
+		}
+		if c.CredentialsRefreshWindow != 0 {
+			return fmt.Errorf("credentials_refresh_window %w, use min_credential_validity instead", ErrRoleSettingWithoutRole)
+		}
+	}
+	if c.MinCredentialValidity > 0 && (c.RoleARN != "" || c.RoleProfile != "" || len(c.RoleARNChain) > 0) {
+		// Without session_duration, roles are assumed for the default of
+		// STS, which is longer with a web identity.
+		sessionDuration := c.SessionDuration
+		switch {
+		case sessionDuration == 0 && c.WebIdentityTokenFile != "":
+			sessionDuration = model.Duration(time.Hour)
+		case sessionDuration == 0:
+			sessionDuration = model.Duration(stscreds.DefaultDuration)
+		}
+		if c.MinCredentialValidity >= sessionDuration {
+			return fmt.Errorf("min_credential_validity must be shorter than the session duration of %s, or the role would be assumed again for every request", sessionDuration)
+		}
+	}
+	if c.WebIdentityTokenFile != "" {
+		if c.RoleARN == "" {
+			return fmt.Errorf("web_identity_token_file requires role_arn to be set")
+		}
+		if c.AccessKey != "" || c.Anonymous {
+			return fmt.Errorf("web_identity_token_file can't be used with access_key or anonymous")
+		}
+		if c.MFASerial != "" {
+			return fmt.Errorf("web_identity_token_file can't be used with mfa_serial")
+		}
+	}
+	if c.Anonymous && c.VerifyCredentials {
+		return fmt.Errorf("verify_credentials can't be used with anonymous")
+	}
+	if c.Anonymous && (c.AccessKey != "" || c.Profile != "" || c.RoleARN != "" || len(c.RoleARNChain) > 0) {
+		return fmt.Errorf("anonymous can't be used with access_key, profile, role_arn or role_arn_chain")
+	}
+	if c.Service != "" && strings.TrimSpace(c.Service) == "" {
+		return fmt.Errorf("service must not be blank")
+	}
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || u.Host == "" {
+			return fmt.Errorf("endpoint must be an absolute URL, got %q", c.Endpoint)
+		}
+	}
+	if c.STSEndpoint != "" {
+		if u, err := url.Parse(c.STSEndpoint); err != nil || u.Host == "" {
+			return fmt.Errorf("sts_endpoint must be an absolute URL, got %q", c.STSEndpoint)
+		}
+	}
+	if c.EC2MetadataEndpoint != "" {
+		if u, err := url.Parse(c.EC2MetadataEndpoint); err != nil || u.Host == "" {
+			return fmt.Errorf("ec2_metadata_endpoint must be an absolute URL, got %q", c.EC2MetadataEndpoint)
+		}
+	}
+	switch c.EC2MetadataEndpointMode {
+	case "", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("ec2_metadata_endpoint_mode must be \"ipv4\" or \"ipv6\", got %q", c.EC2MetadataEndpointMode)
+	}
+	if c.RetryOnNetworkError < 0 {
+		return fmt.Errorf("retry_on_network_error must not be negative")
+	}
+	if c.RetryOnThrottling < 0 {
+		return fmt.Errorf("retry_on_throttling must not be negative")
+	}
+	if c.MaxSignRetries < 0 {
+		return fmt.Errorf("max_sign_retries must not be negative")
+	}
+	if c.MaxSignedHeaders < 0 {
+		return fmt.Errorf("max_signed_headers must not be negative")
+	}
+	if c.SoftBodySizeWarn < 0 {
+		return fmt.Errorf("soft_body_size_warn must not be negative")
+	}
+	for _, h := range c.SignedHeaders {
+		if strings.TrimSpace(h) == "" {
+			return fmt.Errorf("signed_headers must not contain blank header names")
+		}
+		if strings.EqualFold(h, "Authorization") {
+			return fmt.Errorf("signed_headers must not contain Authorization")
+		}
+	}
+	switch c.SigningAlgorithm {
+	case "", SigningAlgorithmSigV4, SigningAlgorithmSigV4A:
+	default:
+		return fmt.Errorf("signing_algorithm must be %q or %q, got %q", SigningAlgorithmSigV4, SigningAlgorithmSigV4A, c.SigningAlgorithm)
+	}
+	if len(c.RegionSet) > 0 && c.SigningAlgorithm != SigningAlgorithmSigV4A {
+		return fmt.Errorf("region_set requires signing_algorithm to be %q", SigningAlgorithmSigV4A)
+	}
+	if c.AllowInsecureUnsignedPayload && !c.UnsignedPayload {
+		return fmt.Errorf("allow_insecure_unsigned_payload requires unsigned_payload to be enabled")
+	}
+	if c.SignDateHeader && !c.AddDateHeader {
+		return fmt.Errorf("sign_date_header requires add_date_header to be enabled")
 	}
 	return nil
 }
 
+// Equal reports whether c and other are the same configuration. Unlike
+// comparing their YAML representations, secrets are compared by value. Empty
+// and unset lists are equal.
+func (c SigV4Config) Equal(other SigV4Config) bool {
+	if !slices.Equal(c.RoleARNChain, other.RoleARNChain) ||
+		!slices.Equal(c.SignedHeaders, other.SignedHeaders) ||
+		!slices.Equal(c.RegionSet, other.RegionSet) {
+		return false
+	}
+	c.RoleARNChain, other.RoleARNChain = nil, nil
+	c.SignedHeaders, other.SignedHeaders = nil, nil
+	c.RegionSet, other.RegionSet = nil, nil
+	return reflect.DeepEqual(c, other)
+}
+
 func (c *SigV4Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain SigV4Config
 	*c = SigV4Config{}
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
+
+	// Keys set to an empty value are usually the result of a template
+	// variable that didn't render, rather than meant to use the default
+	// credential chain like absent keys.
+	var keys map[string]interface{}
+	if err := unmarshal(&keys); err != nil {
+		return err
+	}
+	for _, key := range []string{"access_key", "secret_key"} {
+		if v, ok := keys[key]; ok && (v == nil || v == "") {
+			return fmt.Errorf("%s is set but empty, remove it to use the default AWS credential chain", key)
+		}
+	}
 	return c.Validate()
 }
+
+// ParseConfig parses a SigV4Config from YAML. Unknown keys are rejected.
+func ParseConfig(data []byte) (*SigV4Config, error) {
+	cfg := &SigV4Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ParseConfigLenient parses a SigV4Config from YAML like ParseConfig, but
+// ignores unknown keys, for configurations embedded alongside sibling keys
+// of other projects. Known keys are still validated.
+func ParseConfigLenient(data []byte) (*SigV4Config, error) {
+	cfg := &SigV4Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -14,10 +14,13 @@
 package sigv4
 
 import (
+	"errors"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v2"
 )
 
@@ -56,4 +59,266 @@ func TestBadSigV4Config(t *testing.T) {
 	if !strings.Contains(err.Error(), "must provide a AWS SigV4 Access key and Secret Key") {
 		t.Errorf("Received unexpected error from unmarshal of %s: %s", filename, err.Error())
 	}
+
+	// Configs built in code are validated the same.
+	cfg := SigV4Config{Region: "us-east-2", AccessKey: "AccessKey", Profile: "profile", RoleARN: "blah:role/arn"}
+	if err := cfg.Validate(); !errors.Is(err, ErrMissingKeys) {
+		t.Errorf("Expected ErrMissingKeys validating bad config, got %v", err)
+	}
+}
+
+func TestSigV4ConfigValidateDateHeader(t *testing.T) {
+	cfg := SigV4Config{SignDateHeader: true}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("Expected error when sign_date_header is set without add_date_header")
+	}
+	cfg.AddDateHeader = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestSigV4ConfigEqual(t *testing.T) {
+	cfg, err := loadSigv4Config("testdata/sigv4_good.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing config: %s", err)
+	}
+
+	other := *cfg
+	if !cfg.Equal(other) {
+		t.Errorf("Expected copies of a config to be equal")
+	}
+
+	other.SecretKey = "OtherSecretKey"
+	if cfg.Equal(other) {
+		t.Errorf("Expected configs with different secret keys to differ")
+	}
+
+	// An empty list, such as "signed_headers: []", is the same as none.
+	other = *cfg
+	other.SignedHeaders, other.RoleARNChain, other.RegionSet = []string{}, []string{}, []string{}
+	if !cfg.Equal(other) {
+		t.Errorf("Expected configs with empty and unset lists to be equal")
+	}
+	other.SignedHeaders = []string{"X-Tenant-Id"}
+	if cfg.Equal(other) {
+		t.Errorf("Expected configs with different signed headers to differ")
+	}
+}
+
+func TestParseConfigLenient(t *testing.T) {
+	content, err := os.ReadFile("testdata/sigv4_unknown_key.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseConfig(content); err == nil {
+		t.Fatalf("Expected error parsing config with unknown key")
+	}
+
+	cfg, err := ParseConfigLenient(content)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing config leniently: %s", err)
+	}
+	if cfg.Region != "us-east-2" || cfg.AccessKey != "AccessKey" {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+
+	// Known keys are still validated.
+	if _, err := ParseConfigLenient([]byte("access_key: AccessKey\nendpoint_override: x\n")); err == nil {
+		t.Fatalf("Expected validation error parsing config leniently")
+	}
+}
+
+func TestSigV4ConfigEmptyKeys(t *testing.T) {
+	for _, content := range []string{
+		"region: us-east-2\naccess_key: \"\"\nsecret_key: \"\"\n",
+		"region: us-east-2\naccess_key:\nsecret_key:\n",
+		"region: us-east-2\naccess_key: AccessKey\nsecret_key: \"\"\n",
+	} {
+		var cfg SigV4Config
+		err := yaml.UnmarshalStrict([]byte(content), &cfg)
+		if err == nil {
+			t.Fatalf("Expected error unmarshaling config with empty keys:\n%s", content)
+		}
+		if !strings.Contains(err.Error(), "is set but empty") {
+			t.Errorf("Unexpected error unmarshaling config with empty keys: %s", err)
+		}
+	}
+
+	var cfg SigV4Config
+	if err := yaml.UnmarshalStrict([]byte("region: us-east-2\n"), &cfg); err != nil {
+		t.Fatalf("Unexpected error unmarshaling config without keys: %s", err)
+	}
+}
+
+func TestSigV4ConfigValidateService(t *testing.T) {
+	for _, service := range []string{"", "aps", "es", "execute-api"} {
+		cfg := SigV4Config{Service: service}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Unexpected error validating service %q: %s", service, err)
+		}
+	}
+	cfg := SigV4Config{Service: "  "}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Expected error validating blank service")
+	}
+}
+
+func TestSigV4ConfigValidateAnonymous(t *testing.T) {
+	cfg := SigV4Config{Anonymous: true, Region: "us-east-2"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Unexpected error validating anonymous config: %s", err)
+	}
+	for _, cfg := range []SigV4Config{
+		{Anonymous: true, AccessKey: "test-id", SecretKey: "secret"},
+		{Anonymous: true, Profile: "default"},
+		{Anonymous: true, RoleARN: "arn:aws:iam::123456789012:role/target"},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error validating anonymous config %+v", cfg)
+		}
+	}
+}
+
+func TestSigV4ConfigValidateRoleSession(t *testing.T) {
+	for _, cfg := range []SigV4Config{
+		{RoleSessionName: "prometheus"},
+		{SessionDuration: model.Duration(time.Hour)},
+		{MFASerial: "arn:aws:iam::123456789012:mfa/user"},
+		{CredentialsRefreshWindow: model.Duration(time.Minute)},
+	} {
+		if err := cfg.Validate(); !errors.Is(err, ErrRoleSettingWithoutRole) {
+			t.Errorf("Expected ErrRoleSettingWithoutRole validating role session without role_arn %+v, got %v", cfg, err)
+		}
+		cfg.RoleARN = "arn:aws:iam::123456789012:role/target"
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Unexpected error validating role session with role_arn: %s", err)
+		}
+	}
+}
+
+func TestSigV4ConfigValidateMinCredentialValidity(t *testing.T) {
+	roleARN := "arn:aws:iam::123456789012:role/target"
+	for _, cfg := range []SigV4Config{
+		{MinCredentialValidity: model.Duration(time.Hour)},
+		{RoleARN: roleARN, MinCredentialValidity: model.Duration(10 * time.Minute)},
+		{RoleARN: roleARN, MinCredentialValidity: model.Duration(20 * time.Minute), SessionDuration: model.Duration(time.Hour)},
+		{RoleARN: roleARN, MinCredentialValidity: model.Duration(20 * time.Minute), WebIdentityTokenFile: "token"},
+	} {
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Unexpected error validating min_credential_validity %+v: %s", cfg, err)
+		}
+	}
+	for _, cfg := range []SigV4Config{
+		{RoleARN: roleARN, MinCredentialValidity: model.Duration(20 * time.Minute)},
+		{RoleARN: roleARN, MinCredentialValidity: model.Duration(time.Hour), SessionDuration: model.Duration(time.Hour)},
+		{RoleARNChain: []string{roleARN}, MinCredentialValidity: model.Duration(15 * time.Minute)},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error validating min_credential_validity not shorter than the session %+v", cfg)
+		}
+	}
+}
+
+func TestSigV4ConfigValidateSharedFiles(t *testing.T) {
+	cfg := SigV4Config{Profile: "tenant", SharedCredentialsFile: "credentials", SharedConfigFile: "config"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Unexpected error validating shared files: %s", err)
+	}
+	for _, cfg := range []SigV4Config{
+		{AccessKey: "test-id", SecretKey: "secret", SharedCredentialsFile: "credentials"},
+		{AccessKey: "test-id", SecretKey: "secret", SharedConfigFile: "config"},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error validating shared files with static keys: %+v", cfg)
+		}
+	}
+}
+
+func TestSigV4ConfigValidateSigningAlgorithm(t *testing.T) {
+	for _, cfg := range []SigV4Config{
+		{},
+		{SigningAlgorithm: "sigv4"},
+		{SigningAlgorithm: "sigv4a"},
+		{SigningAlgorithm: "sigv4a", RegionSet: []string{"us-east-1", "us-west-2"}},
+	} {
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Unexpected error validating signing algorithm %+v: %s", cfg, err)
+		}
+	}
+	for _, cfg := range []SigV4Config{
+		{SigningAlgorithm: "sigv2"},
+		{RegionSet: []string{"us-east-1"}},
+		{SigningAlgorithm: "sigv4", RegionSet: []string{"us-east-1"}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error validating signing algorithm %+v", cfg)
+		}
+	}
+}
+
+func TestSigV4ConfigValidateSignedHeaders(t *testing.T) {
+	cfg := SigV4Config{SignedHeaders: []string{"X-Tenant-Id", "Uber-Trace-Id"}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Unexpected error validating signed headers: %s", err)
+	}
+	for _, headers := range [][]string{{""}, {"authorization"}} {
+		cfg := SigV4Config{SignedHeaders: headers}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error validating signed headers %q", headers)
+		}
+	}
+}
+
+func TestSigV4ConfigValidateWebIdentity(t *testing.T) {
+	cfg := SigV4Config{WebIdentityTokenFile: "token", RoleARN: "arn:aws:iam::123456789012:role/target"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Unexpected error validating web identity: %s", err)
+	}
+	for _, cfg := range []SigV4Config{
+		{WebIdentityTokenFile: "token"},
+		{WebIdentityTokenFile: "token", RoleARN: "arn:aws:iam::123456789012:role/target", AccessKey: "test-id", SecretKey: "secret"},
+		{WebIdentityTokenFile: "token", RoleARN: "arn:aws:iam::123456789012:role/target", MFASerial: "arn:aws:iam::123456789012:mfa/user"},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error validating web identity %+v", cfg)
+		}
+	}
+}
+
+func TestSigV4ConfigValidateRoleARNChain(t *testing.T) {
+	chain := []string{"arn:aws:iam::123456789012:role/landing", "arn:aws:iam::210987654321:role/target"}
+	cfg := SigV4Config{RoleARNChain: chain, RoleSessionName: "prometheus"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Unexpected error validating role_arn_chain: %s", err)
+	}
+	for _, cfg := range []SigV4Config{
+		{RoleARNChain: []string{"arn:aws:iam::123456789012:role/landing", "target"}},
+		{RoleARNChain: chain, RoleARN: "arn:aws:iam::123456789012:role/target"},
+		{RoleARNChain: chain, Profile: "source", RoleProfile: "target"},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error validating role_arn_chain %+v", cfg)
+		}
+	}
+}
+
+func TestSigV4ConfigValidateEC2Metadata(t *testing.T) {
+	for _, cfg := range []SigV4Config{
+		{EC2MetadataEndpointMode: "ipv4"},
+		{EC2MetadataEndpointMode: "ipv6", EC2MetadataEndpoint: "http://[fd00:ec2::254]"},
+	} {
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Unexpected error validating EC2 metadata settings %+v: %s", cfg, err)
+		}
+	}
+	for _, cfg := range []SigV4Config{
+		{EC2MetadataEndpointMode: "dualstack"},
+		{EC2MetadataEndpoint: "169.254.169.254"},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error validating EC2 metadata settings %+v", cfg)
+		}
+	}
 }
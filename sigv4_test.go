@@ -14,10 +14,27 @@
 package sigv4
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -55,16 +72,18 @@ func TestSigV4RoundTripper(t *testing.T) {
 	var gotReq *http.Request
 
 	rt := &sigV4RoundTripper{
-		region: "us-east-2",
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
 		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
 			gotReq = req
 			return &http.Response{StatusCode: http.StatusOK}, nil
 		}),
-		signer: signer.NewSigner(credentials.NewStaticCredentials(
+		creds: credentials.NewStaticCredentials(
 			"test-id",
 			"secret",
 			"token",
-		)),
+		),
 	}
 	rt.pool.New = rt.newBuf
 
@@ -115,3 +134,2370 @@ func TestSigV4RoundTripper(t *testing.T) {
 		require.NoError(t, err)
 	})
 }
+
+func TestSigV4RoundTripper_DuplicateHeaders(t *testing.T) {
+	// Request, credentials and signature are taken from the get-header-key-duplicate
+	// case of the AWS SigV4 test suite.
+	const expected = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;my-header1;x-amz-date, " +
+		"Signature=c9d5ea9f3f72853aea855b47ea873832890dbdd183b4468f858259531a5138ea"
+
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-1",
+		service: "service",
+		timeNow: func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		creds: credentials.NewStaticCredentials(
+			"AKIDEXAMPLE",
+			"wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+			"",
+		),
+	}
+	rt.pool.New = rt.newBuf
+
+	t.Run("Canonical keys", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+		require.NoError(t, err)
+		req.Header.Add("My-Header1", "value2")
+		req.Header.Add("My-Header1", "value2")
+		req.Header.Add("My-Header1", "value1")
+
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, expected, gotReq.Header.Get("Authorization"))
+	})
+
+	t.Run("Mixed case keys", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+		require.NoError(t, err)
+		req.Header["My-Header1"] = []string{"value2", "value2"}
+		req.Header["my-header1"] = []string{"value1"}
+
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, expected, gotReq.Header.Get("Authorization"))
+		require.Equal(t, []string{"value2", "value2", "value1"}, gotReq.Header["My-Header1"])
+		require.NotContains(t, gotReq.Header, "my-header1")
+	})
+}
+
+func TestSigV4RoundTripper_CompressBody(t *testing.T) {
+	var (
+		gotReq  *http.Request
+		gotBody []byte
+	)
+	rt := &sigV4RoundTripper{
+		region: "us-east-2",
+		// The S3 service makes the signer emit the payload hash it signed.
+		service:      "s3",
+		compressBody: true,
+		timeNow:      time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			var err error
+			gotBody, err = io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		creds: credentials.NewStaticCredentials(
+			"test-id",
+			"secret",
+			"token",
+		),
+	}
+	rt.pool.New = rt.newBuf
+
+	t.Run("Compressed", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+
+		require.Equal(t, "gzip", gotReq.Header.Get("Content-Encoding"))
+		require.Equal(t, int64(len(gotBody)), gotReq.ContentLength)
+
+		sum := sha256.Sum256(gotBody)
+		require.Equal(t, hex.EncodeToString(sum[:]), gotReq.Header.Get("X-Amz-Content-Sha256"))
+		require.Contains(t, gotReq.Header.Get("Authorization"), "content-encoding")
+
+		zr, err := gzip.NewReader(bytes.NewReader(gotBody))
+		require.NoError(t, err)
+		plain, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world!", string(plain))
+	})
+
+	t.Run("Already encoded", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", "snappy")
+
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+
+		require.Equal(t, "snappy", gotReq.Header.Get("Content-Encoding"))
+		require.Equal(t, "Hello, world!", string(gotBody))
+	})
+}
+
+// expiringProvider hands out credentials that are valid for ten minutes from
+// the time they were retrieved.
+type expiringProvider struct {
+	credentials.Expiry
+
+	now       func() time.Time
+	retrieved int
+}
+
+func (p *expiringProvider) Retrieve() (credentials.Value, error) {
+	p.retrieved++
+	p.SetExpiration(p.now().Add(10*time.Minute), 0)
+	return credentials.Value{AccessKeyID: "test-id", SecretAccessKey: "secret"}, nil
+}
+
+func TestSigV4RoundTripper_MinCredentialValidity(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	provider := &expiringProvider{now: clock}
+	provider.CurrentTime = clock
+
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: clock,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		minCredentialValidity: 5 * time.Minute,
+		creds:                 credentials.NewCredentials(provider),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func() {
+		req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	roundTrip()
+	require.Equal(t, 1, provider.retrieved)
+
+	// Six minutes of validity left, credentials are reused.
+	now = now.Add(4 * time.Minute)
+	roundTrip()
+	require.Equal(t, 1, provider.retrieved)
+
+	// Four minutes of validity left, credentials are refreshed.
+	now = now.Add(2 * time.Minute)
+	roundTrip()
+	require.Equal(t, 2, provider.retrieved)
+
+	// Credentials that never remain valid for long enough aren't refreshed
+	// for every request. Those just refreshed are used as is.
+	rt.minCredentialValidity = 15 * time.Minute
+	for i := 0; i < 3; i++ {
+		roundTrip()
+	}
+	require.Equal(t, 2, provider.retrieved)
+
+	// Once they expire, their replacement is refreshed once.
+	now = now.Add(11 * time.Minute)
+	for i := 0; i < 3; i++ {
+		roundTrip()
+	}
+	require.Equal(t, 4, provider.retrieved)
+}
+
+func TestSigV4RoundTripper_SignObserver(t *testing.T) {
+	var (
+		gotReq  *http.Request
+		amzDate string
+	)
+	var o options
+	WithSignObserver(func(req *http.Request, date string) {
+		amzDate = date
+	})(&o)
+
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time { return time.Date(2021, 6, 1, 10, 20, 30, 0, time.UTC) },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		signObserver: o.signObserver,
+		creds: credentials.NewStaticCredentials(
+			"test-id",
+			"secret",
+			"token",
+		),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Equal(t, "20210601T102030Z", amzDate)
+	require.Equal(t, gotReq.Header.Get("X-Amz-Date"), amzDate)
+}
+
+func TestSigV4RoundTripper_RetryOnNetworkError(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var (
+		calls  int
+		bodies []string
+		dates  []string
+		errs   []error
+	)
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			bodies = append(bodies, string(body))
+			dates = append(dates, req.Header.Get("X-Amz-Date"))
+
+			err = errs[calls]
+			calls++
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		networkErrorRetries: 2,
+		creds: credentials.NewStaticCredentials(
+			"test-id",
+			"secret",
+			"token",
+		),
+	}
+	rt.pool.New = rt.newBuf
+
+	connReset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+	for _, tc := range []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "Success after retry", errs: []error{connReset, nil}, wantCalls: 2},
+		{name: "EOF", errs: []error{io.EOF, nil}, wantCalls: 2},
+		{name: "Retries exhausted", errs: []error{connReset, connReset, connReset}, wantCalls: 3, wantErr: syscall.ECONNRESET},
+		{name: "Not a network error", errs: []error{errors.New("boom")}, wantCalls: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls, bodies, dates, errs = 0, nil, nil, tc.errs
+
+			req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+			require.NoError(t, err)
+
+			_, err = rt.RoundTrip(req)
+			switch {
+			case tc.wantErr != nil:
+				require.ErrorIs(t, err, tc.wantErr)
+			case tc.errs[len(tc.errs)-1] != nil:
+				require.Error(t, err)
+			default:
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.wantCalls, calls)
+
+			for i := range bodies {
+				require.Equal(t, "Hello, world!", bodies[i])
+				if i > 0 {
+					// Every attempt must be signed again.
+					require.NotEqual(t, dates[i-1], dates[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNewStaticSigV4RoundTripper(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_PROFILE", "does-not-exist")
+
+	var gotReq *http.Request
+	rt, err := NewStaticSigV4RoundTripper("static-id", "static-secret", "", "us-east-2", "es",
+		RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	auth := gotReq.Header.Get("Authorization")
+	require.Contains(t, auth, "Credential=static-id/")
+	require.Contains(t, auth, "/us-east-2/es/aws4_request")
+	require.Empty(t, gotReq.Header.Get("X-Amz-Security-Token"))
+
+	_, err = NewStaticSigV4RoundTripper("", "static-secret", "", "us-east-2", "es", nil)
+	require.Error(t, err)
+	_, err = NewStaticSigV4RoundTripper("static-id", "static-secret", "", "", "es", nil)
+	require.Error(t, err)
+}
+
+// countingProvider returns new credentials whenever it is expired, counting
+// its retrievals.
+type countingProvider struct {
+	retrieved int
+	expired   bool
+}
+
+func (p *countingProvider) Retrieve() (credentials.Value, error) {
+	p.retrieved++
+	p.expired = false
+	return credentials.Value{AccessKeyID: fmt.Sprintf("id-%d", p.retrieved), SecretAccessKey: "secret"}, nil
+}
+
+func (p *countingProvider) IsExpired() bool { return p.expired }
+
+func TestNewSigV4RoundTripperWithCredentials(t *testing.T) {
+	var gotReq *http.Request
+	provider := &countingProvider{}
+	rt, err := NewSigV4RoundTripperWithCredentials("us-east-2", "", provider,
+		RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}))
+	require.NoError(t, err)
+
+	send := func() string {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		return gotReq.Header.Get("Authorization")
+	}
+
+	// Credentials are cached until the provider expires them.
+	require.Contains(t, send(), "Credential=id-1/20")
+	require.Contains(t, send(), "Credential=id-1/20")
+	require.Equal(t, 1, provider.retrieved)
+
+	provider.expired = true
+	require.Contains(t, send(), "Credential=id-2/20")
+	require.Contains(t, gotReq.Header.Get("Authorization"), "/us-east-2/aps/aws4_request")
+	require.Equal(t, 2, provider.retrieved)
+
+	_, err = NewSigV4RoundTripperWithCredentials("us-east-2", "aps", nil, nil)
+	require.Error(t, err)
+	_, err = NewSigV4RoundTripperWithCredentials("", "aps", provider, nil)
+	require.Error(t, err)
+}
+
+func TestSigV4RoundTripper_DateHeader(t *testing.T) {
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time { return time.Date(2021, 6, 1, 10, 20, 30, 0, time.UTC) },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		addDateHeader: true,
+		creds: credentials.NewStaticCredentials(
+			"test-id",
+			"secret",
+			"token",
+		),
+	}
+	rt.pool.New = rt.newBuf
+
+	for _, signed := range []bool{false, true} {
+		rt.signDateHeader = signed
+
+		req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+
+		require.Equal(t, "20210601T102030Z", gotReq.Header.Get("X-Amz-Date"))
+		require.Equal(t, "Tue, 01 Jun 2021 10:20:30 GMT", gotReq.Header.Get("Date"))
+		if signed {
+			require.Contains(t, gotReq.Header.Get("Authorization"), "SignedHeaders=date;host;")
+		} else {
+			require.Contains(t, gotReq.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;")
+		}
+	}
+}
+
+// fakeSTS sets the transport of http.DefaultClient, which the AWS SDK sends its
+// requests through by default, to one that answers STS AssumeRole calls. The
+// parsed forms of the received STS calls are returned.
+func fakeSTS(t *testing.T) *[]url.Values {
+	t.Helper()
+
+	// A custom CA bundle makes the SDK replace the transport of the client.
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var calls []url.Values
+	orig := http.DefaultClient.Transport
+	http.DefaultClient.Transport = RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasPrefix(req.URL.Host, "sts.") || req.Body == nil {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody, Request: req}, nil
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		form.Set("Authorization", req.Header.Get("Authorization"))
+		calls = append(calls, form)
+
+		// AssumeRoleWithWebIdentity responds with the same elements under
+		// other names.
+		action := form.Get("Action")
+		resp := fmt.Sprintf(`<%[3]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[3]sResult>
+    <Credentials>
+      <AccessKeyId>ASIA%[1]d</AccessKeyId>
+      <SecretAccessKey>role-secret</SecretAccessKey>
+      <SessionToken>role-token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>%[2]s</Arn>
+      <AssumedRoleId>AROA:session</AssumedRoleId>
+    </AssumedRoleUser>
+  </%[3]sResult>
+  <ResponseMetadata><RequestId>request-id</RequestId></ResponseMetadata>
+</%[3]sResponse>`, len(calls), form.Get("RoleArn"), action)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/xml"}},
+			Body:       io.NopCloser(strings.NewReader(resp)),
+			Request:    req,
+		}, nil
+	})
+	t.Cleanup(func() { http.DefaultClient.Transport = orig })
+
+	return &calls
+}
+
+func TestSigV4RoundTripper_RoleProfile(t *testing.T) {
+	dir := t.TempDir()
+	credsFile := filepath.Join(dir, "credentials")
+	require.NoError(t, os.WriteFile(credsFile, []byte(`[source]
+aws_access_key_id = source-id
+aws_secret_access_key = source-secret
+`), 0o600))
+	configFile := filepath.Join(dir, "config")
+	require.NoError(t, os.WriteFile(configFile, []byte(`[profile source]
+region = us-east-2
+
+[profile target]
+role_arn = arn:aws:iam::123456789012:role/target
+`), 0o600))
+
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credsFile)
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	stsCalls := fakeSTS(t)
+
+	var gotReq *http.Request
+	rt, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:      "us-east-2",
+		Profile:     "source",
+		RoleProfile: "target",
+	}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Len(t, *stsCalls, 1)
+	require.Equal(t, "arn:aws:iam::123456789012:role/target", (*stsCalls)[0].Get("RoleArn"))
+	require.Contains(t, (*stsCalls)[0].Get("Authorization"), "Credential=source-id/")
+	require.Contains(t, gotReq.Header.Get("Authorization"), "Credential=ASIA1/")
+
+	t.Run("Missing role profile", func(t *testing.T) {
+		_, err := NewSigV4RoundTripper(&SigV4Config{
+			Region:      "us-east-2",
+			Profile:     "source",
+			RoleProfile: "missing",
+		}, nil)
+		require.ErrorContains(t, err, `profile "missing" not found`)
+	})
+
+	t.Run("Role profile without role", func(t *testing.T) {
+		_, err := NewSigV4RoundTripper(&SigV4Config{
+			Region:      "us-east-2",
+			Profile:     "source",
+			RoleProfile: "source",
+		}, nil)
+		require.ErrorContains(t, err, "has no role_arn")
+	})
+
+	t.Run("Missing source profile", func(t *testing.T) {
+		_, err := NewSigV4RoundTripper(&SigV4Config{
+			Region:      "us-east-2",
+			Profile:     "missing",
+			RoleProfile: "target",
+		}, nil)
+		require.Error(t, err)
+	})
+}
+
+// trackingBody is a response body recording whether it was fully read and
+// closed.
+type trackingBody struct {
+	io.Reader
+	drained, closed bool
+}
+
+func (b *trackingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.drained = true
+	}
+	return n, err
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+type fakeResponse struct {
+	status int
+	body   string
+}
+
+func TestSigV4RoundTripper_ExpiredToken(t *testing.T) {
+	const expiredToken = `{"__type":"com.amazon.coral.service#ExpiredTokenException",` +
+		`"message":"The security token included in the request is expired"}`
+
+	provider := &expiringProvider{now: time.Now}
+
+	var (
+		responses []fakeResponse
+		bodies    []*trackingBody
+	)
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			r := responses[len(bodies)]
+			body := &trackingBody{Reader: strings.NewReader(r.body)}
+			bodies = append(bodies, body)
+			return &http.Response{StatusCode: r.status, Body: body}, nil
+		}),
+		creds: credentials.NewCredentials(provider),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func(r ...fakeResponse) *http.Response {
+		responses, bodies, provider.retrieved = r, nil, 0
+
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Retried once", func(t *testing.T) {
+		resp := roundTrip(
+			fakeResponse{http.StatusForbidden, expiredToken},
+			fakeResponse{http.StatusOK, "ok"},
+		)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, bodies, 2)
+		require.True(t, bodies[0].drained)
+		require.True(t, bodies[0].closed)
+		require.Equal(t, 2, provider.retrieved)
+	})
+
+	t.Run("Not retried twice", func(t *testing.T) {
+		resp := roundTrip(
+			fakeResponse{http.StatusForbidden, expiredToken},
+			fakeResponse{http.StatusForbidden, expiredToken},
+		)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		require.Len(t, bodies, 2)
+		require.True(t, bodies[0].closed)
+		require.False(t, bodies[1].closed)
+	})
+
+	t.Run("Retried up to max_sign_retries", func(t *testing.T) {
+		rt.signRetries, rt.signRetryBackoff = 3, time.Millisecond
+		t.Cleanup(func() { rt.signRetries, rt.signRetryBackoff = 0, 0 })
+
+		resp := roundTrip(
+			fakeResponse{http.StatusForbidden, expiredToken},
+			fakeResponse{http.StatusForbidden, expiredToken},
+			fakeResponse{http.StatusForbidden, expiredToken},
+			fakeResponse{http.StatusOK, "ok"},
+		)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, bodies, 4)
+
+		resp = roundTrip(
+			fakeResponse{http.StatusForbidden, expiredToken},
+			fakeResponse{http.StatusForbidden, expiredToken},
+			fakeResponse{http.StatusForbidden, expiredToken},
+			fakeResponse{http.StatusForbidden, expiredToken},
+		)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		require.Len(t, bodies, 4)
+
+		// Other errors are still not retried.
+		resp = roundTrip(fakeResponse{http.StatusForbidden, "AccessDeniedException"})
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		require.Len(t, bodies, 1)
+	})
+
+	t.Run("Other forbidden errors", func(t *testing.T) {
+		resp := roundTrip(fakeResponse{http.StatusForbidden, "AccessDeniedException"})
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		require.Len(t, bodies, 1)
+		require.Zero(t, provider.retrieved)
+
+		// The body must still be readable by the caller.
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "AccessDeniedException", string(body))
+	})
+
+	t.Run("Oversized error body", func(t *testing.T) {
+		large := strings.Repeat("x", 1<<20)
+		resp := roundTrip(fakeResponse{http.StatusForbidden, large})
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		require.Len(t, bodies, 1)
+
+		// Only the start of the body is inspected.
+		require.Equal(t, len(large)-maxErrorResponseInspectSize, bodies[0].Reader.(*strings.Reader).Len())
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, large, string(body))
+		require.NoError(t, resp.Body.Close())
+		require.True(t, bodies[0].closed)
+	})
+}
+
+func TestSigV4RoundTripper_SigningHostUnixSocket(t *testing.T) {
+	const signingHost = "aps-workspaces.us-east-2.amazonaws.com"
+
+	// Keep the socket path short, as it is limited to about 100 characters.
+	dir, err := os.MkdirTemp("", "sigv4")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "proxy.sock")
+
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	var gotReq *http.Request
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotReq = r
+	}))
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	signTime := time.Now()
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time { return signTime },
+		next: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+		signingHost: signingHost,
+		creds:       credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/api/v1/remote_write", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Equal(t, signingHost, gotReq.Host)
+
+	// The request must be signed as if it was sent to the AWS endpoint.
+	want, err := http.NewRequest(http.MethodPost, "https://"+signingHost+"/api/v1/remote_write", nil)
+	require.NoError(t, err)
+	var s v4Signer
+	_, err = s.sign(want, hashSHA256([]byte("Hello, world!")), credentials.Value{AccessKeyID: "test-id", SecretAccessKey: "secret"}, "aps", "us-east-2", signTime)
+	require.NoError(t, err)
+	require.Equal(t, want.Header.Get("Authorization"), gotReq.Header.Get("Authorization"))
+}
+
+func TestSigV4RoundTripper_UnsignedPayload(t *testing.T) {
+	signTime := time.Now()
+
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time { return signTime },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		unsignedPayload: true,
+		creds:           credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func(url string) error {
+		gotReq = nil
+		req, err := http.NewRequest(http.MethodPost, url, strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		return err
+	}
+
+	t.Run("HTTPS", func(t *testing.T) {
+		require.NoError(t, roundTrip("https://example.com"))
+		require.Equal(t, "UNSIGNED-PAYLOAD", gotReq.Header.Get("X-Amz-Content-Sha256"))
+
+		want, err := http.NewRequest(http.MethodPost, "https://example.com", nil)
+		require.NoError(t, err)
+		var s v4Signer
+		_, err = s.sign(want, "UNSIGNED-PAYLOAD", credentials.Value{AccessKeyID: "test-id", SecretAccessKey: "secret"}, "aps", "us-east-2", signTime)
+		require.NoError(t, err)
+		require.Equal(t, want.Header.Get("Authorization"), gotReq.Header.Get("Authorization"))
+	})
+
+	t.Run("Body passed through", func(t *testing.T) {
+		body := &trackingBody{Reader: strings.NewReader("Hello, world!")}
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", body)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+
+		require.Equal(t, "UNSIGNED-PAYLOAD", gotReq.Header.Get("X-Amz-Content-Sha256"))
+		require.Same(t, body, gotReq.Body)
+		require.False(t, body.drained)
+		require.False(t, body.closed)
+	})
+
+	t.Run("HTTP", func(t *testing.T) {
+		require.ErrorContains(t, roundTrip("http://example.com"), "refusing to send request with unsigned payload over http")
+		require.Nil(t, gotReq)
+	})
+
+	t.Run("HTTP allowed", func(t *testing.T) {
+		rt.allowInsecureUnsignedPayload = true
+		t.Cleanup(func() { rt.allowInsecureUnsignedPayload = false })
+
+		require.NoError(t, roundTrip("http://example.com"))
+		require.Equal(t, "UNSIGNED-PAYLOAD", gotReq.Header.Get("X-Amz-Content-Sha256"))
+	})
+}
+
+// failingProvider fails to retrieve credentials, counting the attempts.
+type failingProvider struct {
+	retrieved int
+}
+
+func (p *failingProvider) Retrieve() (credentials.Value, error) {
+	p.retrieved++
+	return credentials.Value{}, errors.New("sts unavailable")
+}
+
+func (p *failingProvider) IsExpired() bool { return true }
+
+func TestSigV4RoundTripper_CredentialsErrorCooldown(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := &failingProvider{}
+
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time { return now },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		credentialsErrorCooldown: time.Minute,
+		creds:                    credentials.NewCredentials(provider),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func() error {
+		req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		return err
+	}
+
+	require.ErrorContains(t, roundTrip(), "sts unavailable")
+	require.Equal(t, 1, provider.retrieved)
+
+	// Within the cooldown, the previous error is returned without retrieval.
+	now = now.Add(30 * time.Second)
+	err := roundTrip()
+	require.ErrorContains(t, err, "sts unavailable")
+	require.ErrorContains(t, err, "after previous failure")
+	require.Equal(t, 1, provider.retrieved)
+
+	now = now.Add(time.Minute)
+	require.ErrorContains(t, roundTrip(), "sts unavailable")
+	require.Equal(t, 2, provider.retrieved)
+}
+
+func TestSigV4RoundTripper_PoolReuse(t *testing.T) {
+	// Keep the garbage collector from emptying the pool.
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		compressBody: true,
+		creds:        credentials.NewCredentials(&failingProvider{}),
+	}
+	var allocs int
+	rt.pool.New = func() interface{} {
+		allocs++
+		return rt.newBuf()
+	}
+
+	// Signing fails after the body was buffered and compressed.
+	const requests = 100
+	for i := 0; i < requests; i++ {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.ErrorContains(t, err, "sts unavailable")
+	}
+
+	// Each request takes a buffer to compress its body from, which is
+	// returned to the pool and reused. The race detector drops a share of
+	// them at random, hence the margin.
+	require.Less(t, allocs, requests)
+	buf := rt.pool.Get().(*bytes.Buffer)
+	require.Zero(t, buf.Len())
+}
+
+func TestSigV4RoundTripper_HTTP10(t *testing.T) {
+	signTime := time.Now()
+
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time { return signTime },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		creds: credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func(req *http.Request) string {
+		_, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		return gotReq.Header.Get("Authorization")
+	}
+
+	req11, err := http.NewRequest(http.MethodGet, "https://example.com:443/test", nil)
+	require.NoError(t, err)
+	want := roundTrip(req11)
+
+	// Requests received by a proxy over HTTP/1.0 may lack a Host, in which case
+	// the host of the URL must be signed.
+	req10, err := http.NewRequest(http.MethodGet, "https://example.com:443/test", nil)
+	require.NoError(t, err)
+	req10.Proto, req10.ProtoMajor, req10.ProtoMinor = "HTTP/1.0", 1, 0
+	req10.Host = ""
+	require.Equal(t, want, roundTrip(req10))
+}
+
+func TestSigV4RoundTripper_DefaultContentType(t *testing.T) {
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "dynamodb",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		defaultContentType: true,
+		creds:              credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodPost, "https://dynamodb.us-east-2.amazonaws.com/", strings.NewReader("{}"))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, "application/x-amz-json-1.0", gotReq.Header.Get("Content-Type"))
+	require.Contains(t, gotReq.Header.Get("Authorization"), "SignedHeaders=content-type;host;x-amz-date,")
+
+	// A Content-Type set by the caller is kept.
+	req, err = http.NewRequest(http.MethodPost, "https://dynamodb.us-east-2.amazonaws.com/", strings.NewReader("{}"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, "application/json", gotReq.Header.Get("Content-Type"))
+}
+
+func TestSigV4RoundTripper_CancelledContext(t *testing.T) {
+	provider := &failingProvider{}
+	var called bool
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			called = true
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		creds: credentials.NewCredentials(provider),
+	}
+	rt.pool.New = rt.newBuf
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+
+	_, err = rt.RoundTrip(req)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Zero(t, provider.retrieved)
+	require.False(t, called)
+}
+
+// blockingProvider blocks credential retrieval until release is closed.
+type blockingProvider struct {
+	release chan struct{}
+}
+
+func (p *blockingProvider) Retrieve() (credentials.Value, error) {
+	<-p.release
+	return credentials.Value{AccessKeyID: "test-id", SecretAccessKey: "secret"}, nil
+}
+
+func (p *blockingProvider) IsExpired() bool { return true }
+
+func TestSigV4RoundTripper_SigningTimeout(t *testing.T) {
+	provider := &blockingProvider{release: make(chan struct{})}
+	t.Cleanup(func() { close(provider.release) })
+
+	var called bool
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			called = true
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		signingTimeout: 10 * time.Millisecond,
+		creds:          credentials.NewCredentials(provider),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = rt.RoundTrip(req)
+	require.ErrorContains(t, err, "failed to sign request")
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.False(t, called)
+}
+
+// TestSigV4RoundTripper_GoldenSignature pins the signing clock to check the
+// exact signature of a request against one computed by the AWS SDK.
+func TestSigV4RoundTripper_GoldenSignature(t *testing.T) {
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time { return testSignTime },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		creds: credentials.NewStaticCredentials("AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodPost, "https://aps-workspaces.us-east-2.amazonaws.com/workspaces/ws-1/api/v1/remote_write", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Equal(t, "20210601T102030Z", gotReq.Header.Get("X-Amz-Date"))
+	require.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20210601/us-east-2/aps/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=ae1813aee465557569df380218d818911e84413cd58012d2bb2b0801b401db97",
+		gotReq.Header.Get("Authorization"))
+}
+
+func TestSigV4RoundTripper_SignedHeaders(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var gotReq *http.Request
+	rt, err := newSigV4RoundTripperFromConfig(context.Background(), &SigV4Config{
+		Region:        "us-east-2",
+		AccessKey:     "test-id",
+		SecretKey:     "secret",
+		SignedHeaders: []string{"x-tenant-id", "Uber-Trace-Id"},
+	}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+	rt.timeNow = func() time.Time { return testSignTime }
+
+	sign := func(header, value string) string {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		req.Header.Set("X-Tenant-Id", "tenant-1")
+		req.Header.Set("Uber-Trace-Id", "trace-1")
+		req.Header.Set("X-Amzn-Trace-Id", "trace-1")
+		req.Header.Set(header, value)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		return gotReq.Header.Get("Authorization")
+	}
+
+	want := sign("X-Tenant-Id", "tenant-1")
+	require.Contains(t, want, "SignedHeaders=host;uber-trace-id;x-amz-date;x-tenant-id,")
+	require.NotEqual(t, want, sign("X-Tenant-Id", "tenant-2"))
+	require.NotEqual(t, want, sign("Uber-Trace-Id", "trace-2"))
+	require.Equal(t, want, sign("X-Amzn-Trace-Id", "trace-2"))
+}
+
+func TestSigV4RoundTripper_DisablePathEscaping(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var gotReq *http.Request
+	rt, err := newSigV4RoundTripperFromConfig(context.Background(), &SigV4Config{
+		Region:              "us-east-2",
+		Service:             "s3",
+		AccessKey:           "test-id",
+		SecretKey:           "secret",
+		DisablePathEscaping: true,
+	}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+	rt.timeNow = func() time.Time { return testSignTime }
+
+	const rawURL = "https://bucket.s3.amazonaws.com/test//a%2Fb"
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, "/test//a%2Fb", gotReq.URL.EscapedPath())
+
+	want, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	require.NoError(t, err)
+	_, err = signer.NewSigner(credentials.NewStaticCredentials("test-id", "secret", ""), func(s *signer.Signer) {
+		s.DisableURIPathEscaping = true
+	}).Sign(want, nil, "s3", "us-east-2", testSignTime)
+	require.NoError(t, err)
+	require.Equal(t, want.Header.Get("Authorization"), gotReq.Header.Get("Authorization"))
+}
+
+func TestSigV4RoundTripper_QuerySpaces(t *testing.T) {
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time { return time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC) },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		creds: credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	sign := func(url string) string {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		return gotReq.Header.Get("Authorization")
+	}
+
+	want := sign("https://example.com/api/v1/query?query=sum%20by%20(job)%20(up)")
+	require.Equal(t, want, sign("https://example.com/api/v1/query?query=sum+by+(job)+(up)"))
+	require.Equal(t, "query=sum%20by%20(job)%20(up)", gotReq.URL.RawQuery)
+}
+
+func TestRegisterServiceDefaults(t *testing.T) {
+	RegisterServiceDefaults("example", ServiceDefaults{
+		PayloadHashHeader: true,
+		ContentType:       "application/example",
+		GlobalRegion:      "us-east-1",
+	})
+	t.Cleanup(func() {
+		servicesMtx.Lock()
+		delete(services, "example")
+		servicesMtx.Unlock()
+	})
+
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "example",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		defaultContentType: true,
+		creds:              credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Equal(t, "application/example", gotReq.Header.Get("Content-Type"))
+	require.Equal(t, hashSHA256([]byte("Hello, world!")), gotReq.Header.Get("X-Amz-Content-Sha256"))
+	auth := gotReq.Header.Get("Authorization")
+	require.Contains(t, auth, "/us-east-1/example/aws4_request")
+	require.Contains(t, auth, "SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date,")
+}
+
+func TestNewSigV4RoundTripper_DoubleSigningCheck(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	inner, err := NewStaticSigV4RoundTripper("test-id", "secret", "", "us-east-2", "aps", nil)
+	require.NoError(t, err)
+
+	cfg := &SigV4Config{Region: "us-east-2", AccessKey: "test-id", SecretKey: "secret"}
+	_, err = NewSigV4RoundTripper(cfg, inner, WithDoubleSigningCheck())
+	require.ErrorContains(t, err, "already signs requests")
+
+	// The check is opt-in.
+	_, err = NewSigV4RoundTripper(cfg, inner)
+	require.NoError(t, err)
+
+	_, err = NewSigV4RoundTripper(cfg, http.DefaultTransport, WithDoubleSigningCheck())
+	require.NoError(t, err)
+}
+
+func TestNewSigV4RoundTripper_Logger(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	_, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:    "us-east-2",
+		AccessKey: "test-id",
+		SecretKey: "secret",
+	}, nil, WithLogger(logger))
+	require.NoError(t, err)
+
+	require.Contains(t, buf.String(), `msg="Resolved SigV4 credentials" source=StaticProvider region=us-east-2`)
+	require.NotContains(t, buf.String(), "secret")
+}
+
+func TestSigV4RoundTripper_ContextCredentials(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	stsCalls := fakeSTS(t)
+
+	var gotReq *http.Request
+	next := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	ctx := ContextWithCredentials(context.Background(), credentials.Value{AccessKeyID: "ctx-id", SecretAccessKey: "ctx-secret"})
+
+	t.Run("Without role", func(t *testing.T) {
+		rt, err := NewSigV4RoundTripper(&SigV4Config{Region: "us-east-2", AccessKey: "test-id", SecretKey: "secret"}, next)
+		require.NoError(t, err)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://example.com", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Contains(t, gotReq.Header.Get("Authorization"), "Credential=ctx-id/")
+		require.Empty(t, *stsCalls)
+	})
+
+	t.Run("With role", func(t *testing.T) {
+		rt, err := NewSigV4RoundTripper(&SigV4Config{
+			Region:    "us-east-2",
+			AccessKey: "test-id",
+			SecretKey: "secret",
+			RoleARN:   "arn:aws:iam::123456789012:role/target",
+		}, next)
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://example.com", nil)
+			require.NoError(t, err)
+			_, err = rt.RoundTrip(req)
+			require.NoError(t, err)
+		}
+
+		// The role is assumed once with the context credentials.
+		require.Len(t, *stsCalls, 1)
+		require.Equal(t, "arn:aws:iam::123456789012:role/target", (*stsCalls)[0].Get("RoleArn"))
+		require.Contains(t, (*stsCalls)[0].Get("Authorization"), "Credential=ctx-id/")
+		require.Contains(t, gotReq.Header.Get("Authorization"), "Credential=ASIA1/")
+	})
+}
+
+func TestSigV4RoundTripper_StripDefaultPort(t *testing.T) {
+	var gotReq *http.Request
+	signTime := time.Now()
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time { return signTime },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		stripDefaultPort: true,
+		creds:            credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com:443/api/v1/query", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, "example.com", gotReq.URL.Host)
+	require.Equal(t, "example.com", gotReq.Host)
+
+	want, err := http.NewRequest(http.MethodGet, "https://example.com/api/v1/query", nil)
+	require.NoError(t, err)
+	var s v4Signer
+	_, err = s.sign(want, hashSHA256(nil), credentials.Value{AccessKeyID: "test-id", SecretAccessKey: "secret"}, "aps", "us-east-2", signTime)
+	require.NoError(t, err)
+	require.Equal(t, want.Header.Get("Authorization"), gotReq.Header.Get("Authorization"))
+
+	// Other ports are kept.
+	req, err = http.NewRequest(http.MethodGet, "https://example.com:8443/api/v1/query", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, "example.com:8443", gotReq.URL.Host)
+}
+
+func TestNewSigV4RoundTripper_S3ObjectLambda(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var gotReq *http.Request
+	rt, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:    "us-east-2",
+		Service:   "s3-object-lambda",
+		AccessKey: "test-id",
+		SecretKey: "secret",
+	}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://ap-123456789012.s3-object-lambda.us-east-2.amazonaws.com/key", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	auth := gotReq.Header.Get("Authorization")
+	require.Contains(t, auth, "/us-east-2/s3-object-lambda/aws4_request")
+	require.Contains(t, auth, "SignedHeaders=host;x-amz-content-sha256;x-amz-date,")
+	require.Equal(t, hashSHA256(nil), gotReq.Header.Get("X-Amz-Content-Sha256"))
+}
+
+func TestSigV4RoundTripper_VerifyContentSHA256(t *testing.T) {
+	var called bool
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "s3",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			called = true
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		verifyContentSHA256: true,
+		creds:               credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func(hash string) error {
+		called = false
+		req, err := http.NewRequest(http.MethodPut, "https://bucket.s3.amazonaws.com/key", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		req.Header.Set("X-Amz-Content-Sha256", hash)
+		_, err = rt.RoundTrip(req)
+		return err
+	}
+
+	err := roundTrip(hashSHA256([]byte("Goodbye, world!")))
+	require.ErrorContains(t, err, "doesn't match the SHA256 of the request body")
+	require.False(t, called)
+
+	require.NoError(t, roundTrip(hashSHA256([]byte("Hello, world!"))))
+	require.True(t, called)
+
+	require.NoError(t, roundTrip(unsignedPayload))
+	require.True(t, called)
+}
+
+func TestSigV4RoundTripper_GetBody(t *testing.T) {
+	var (
+		bodies  []string
+		getBody func() (io.ReadCloser, error)
+	)
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			bodies = append(bodies, string(body))
+
+			require.NotNil(t, req.GetBody)
+			if getBody == nil {
+				getBody = req.GetBody
+			}
+			rc, err := req.GetBody()
+			require.NoError(t, err)
+			body, err = io.ReadAll(rc)
+			require.NoError(t, err)
+			bodies = append(bodies, string(body))
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		creds: credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com", io.NopCloser(strings.NewReader("Hello, world!")))
+	require.NoError(t, err)
+	require.Nil(t, req.GetBody)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Hello, world!", "Hello, world!"}, bodies)
+
+	// GetBody still replays the first body once RoundTrip has returned and
+	// its buffer was reused by another request, e.g. for a redirect.
+	req, err = http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Goodbye, world"))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	rc, err := getBody()
+	require.NoError(t, err)
+	body, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(body))
+}
+
+func TestSigV4RoundTripper_RetryOnThrottling(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var (
+		responses []*http.Response
+		dates     []string
+	)
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			dates = append(dates, req.Header.Get("X-Amz-Date"))
+			resp := responses[0]
+			responses = responses[1:]
+			return resp, nil
+		}),
+		throttlingRetries: 1,
+		creds:             credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	throttled := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Retry-After": []string{"0"}},
+			Body:       &trackingBody{Reader: strings.NewReader("ThrottlingException")},
+		}
+	}
+	roundTrip := func(r ...*http.Response) *http.Response {
+		responses, dates = r, nil
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Retried", func(t *testing.T) {
+		first := throttled()
+		resp := roundTrip(first, &http.Response{StatusCode: http.StatusOK})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, dates, 2)
+		require.NotEqual(t, dates[0], dates[1])
+		require.True(t, first.Body.(*trackingBody).closed)
+	})
+
+	t.Run("Retries exhausted", func(t *testing.T) {
+		resp := roundTrip(throttled(), throttled())
+		require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		require.Len(t, dates, 2)
+	})
+
+	t.Run("Retry-After too long", func(t *testing.T) {
+		first := throttled()
+		first.Header.Set("Retry-After", "86400")
+		resp := roundTrip(first)
+		require.Same(t, first, resp)
+		require.Len(t, dates, 1)
+	})
+
+	t.Run("Context done while waiting", func(t *testing.T) {
+		resp := throttled()
+		resp.Header.Set("Retry-After", "30")
+		responses = []*http.Response{resp}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for h, want := range map[string]time.Duration{
+		"":                              defaultRetryAfter,
+		"5":                             5 * time.Second,
+		"-1":                            defaultRetryAfter,
+		"Fri, 01 Jan 2021 00:00:10 GMT": 10 * time.Second,
+		"soon":                          defaultRetryAfter,
+	} {
+		resp := &http.Response{Header: http.Header{"Retry-After": []string{h}}}
+		require.Equal(t, want, retryAfter(resp, now), h)
+	}
+}
+
+func TestNewSigV4RoundTripper_ExplicitService(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var gotReq *http.Request
+	next := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	for _, tc := range []struct {
+		cfg  SigV4Config
+		url  string
+		want string
+	}{
+		// The host of a proxy doesn't reveal the service.
+		{cfg: SigV4Config{Service: "es"}, url: "https://proxy.internal/_search", want: "/us-east-2/es/aws4_request"},
+		// Nor does the host of another service override the configured one.
+		{cfg: SigV4Config{Service: "es"}, url: "https://aps-workspaces.us-east-2.amazonaws.com/", want: "/us-east-2/es/aws4_request"},
+		{cfg: SigV4Config{Service: "es", SigningHost: "aps-workspaces.us-east-2.amazonaws.com"}, url: "http://localhost/", want: "/us-east-2/es/aws4_request"},
+		{cfg: SigV4Config{}, url: "https://search-domain.us-east-2.es.amazonaws.com/", want: "/us-east-2/aps/aws4_request"},
+	} {
+		cfg := tc.cfg
+		cfg.Region, cfg.AccessKey, cfg.SecretKey = "us-east-2", "test-id", "secret"
+		rt, err := NewSigV4RoundTripper(&cfg, next)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Contains(t, gotReq.Header.Get("Authorization"), tc.want, tc.url)
+	}
+}
+
+func TestSigV4RoundTripper_CallerAmzHeaders(t *testing.T) {
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "s3",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		creds: credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodPut, "https://bucket.s3.amazonaws.com/key", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	req.Header.Set("X-Amz-Server-Side-Encryption", "aws:kms")
+	req.Header.Set("x-amz-storage-class", "STANDARD_IA")
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Equal(t, "aws:kms", gotReq.Header.Get("X-Amz-Server-Side-Encryption"))
+	require.Equal(t, "STANDARD_IA", gotReq.Header.Get("X-Amz-Storage-Class"))
+	require.Contains(t, gotReq.Header.Get("Authorization"),
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-server-side-encryption;x-amz-storage-class,")
+}
+
+func TestSigV4RoundTripper_DefaultToHTTPS(t *testing.T) {
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		creds: credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodGet, "https://example.com:443/api/v1/query", nil)
+		require.NoError(t, err)
+		req.URL.Scheme = ""
+		return req
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		gotReq = nil
+		_, err := rt.RoundTrip(newRequest())
+		require.ErrorContains(t, err, "has no scheme")
+		require.Nil(t, gotReq)
+	})
+
+	t.Run("Default to https", func(t *testing.T) {
+		rt.defaultToHTTPS = true
+		_, err := rt.RoundTrip(newRequest())
+		require.NoError(t, err)
+		require.Equal(t, "https", gotReq.URL.Scheme)
+
+		// The default port of https isn't part of the signed host.
+		want, err := http.NewRequest(http.MethodGet, "https://example.com/api/v1/query", nil)
+		require.NoError(t, err)
+		require.Equal(t, canonicalHost(want), canonicalHost(gotReq))
+	})
+}
+
+func TestSigV4RoundTripper_FollowRegionHint(t *testing.T) {
+	var (
+		responses []*http.Response
+		auths     []string
+	)
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "s3",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			auths = append(auths, req.Header.Get("Authorization"))
+			resp := responses[0]
+			responses = responses[1:]
+			return resp, nil
+		}),
+		followRegionHint: true,
+		creds:            credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	wrongRegion := func(region string) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusMovedPermanently,
+			Header:     http.Header{"X-Amz-Bucket-Region": []string{region}},
+			Body:       &trackingBody{Reader: strings.NewReader("PermanentRedirect")},
+		}
+	}
+	roundTrip := func(r ...*http.Response) *http.Response {
+		responses, auths = r, nil
+		req, err := http.NewRequest(http.MethodGet, "https://bucket.s3.amazonaws.com/key", nil)
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Retried once", func(t *testing.T) {
+		first := wrongRegion("eu-west-1")
+		resp := roundTrip(first, &http.Response{StatusCode: http.StatusOK})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, auths, 2)
+		require.Contains(t, auths[0], "/us-east-2/s3/aws4_request")
+		require.Contains(t, auths[1], "/eu-west-1/s3/aws4_request")
+		require.True(t, first.Body.(*trackingBody).closed)
+	})
+
+	t.Run("Not retried twice", func(t *testing.T) {
+		resp := roundTrip(wrongRegion("eu-west-1"), wrongRegion("eu-central-1"))
+		require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+		require.Len(t, auths, 2)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		rt.followRegionHint = false
+		resp := roundTrip(wrongRegion("eu-west-1"))
+		require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+		require.Len(t, auths, 1)
+	})
+}
+
+func TestSigV4RoundTripper_RegionFromHeader(t *testing.T) {
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		regionHeader: "X-Target-Region",
+		creds:        credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	req.Header.Set("X-Target-Region", "eu-west-1")
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Contains(t, gotReq.Header.Get("Authorization"), "/eu-west-1/aps/aws4_request")
+	require.NotContains(t, gotReq.Header.Get("Authorization"), "x-target-region")
+	require.Empty(t, gotReq.Header.Values("X-Target-Region"))
+	// The header is only stripped from the request sent, so that the region
+	// still applies if the caller sends its request again.
+	require.Equal(t, "eu-west-1", req.Header.Get("X-Target-Region"))
+
+	// Requests without the header are signed for the configured region.
+	req, err = http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Contains(t, gotReq.Header.Get("Authorization"), "/us-east-2/aps/aws4_request")
+}
+
+func TestSigV4RoundTripper_ServiceFromHeader(t *testing.T) {
+	var gotReq *http.Request
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		serviceHeader: "X-Target-Service",
+		creds:         credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	req.Header.Set("X-Target-Service", "s3")
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Contains(t, gotReq.Header.Get("Authorization"), "/us-east-2/s3/aws4_request")
+	require.NotContains(t, gotReq.Header.Get("Authorization"), "x-target-service")
+	require.Empty(t, gotReq.Header.Values("X-Target-Service"))
+	require.Equal(t, "s3", req.Header.Get("X-Target-Service"))
+	// The defaults of the service from the header apply.
+	require.Equal(t, hashSHA256([]byte("Hello, world!")), gotReq.Header.Get("X-Amz-Content-Sha256"))
+
+	// Requests without the header are signed for the configured service.
+	req, err = http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Contains(t, gotReq.Header.Get("Authorization"), "/us-east-2/aps/aws4_request")
+}
+
+func TestNewSigV4RoundTripper_LazyCredentials(t *testing.T) {
+	// Credentials from an instance metadata service that never responds.
+	cfg := &SigV4Config{Region: "us-east-2", EC2MetadataEndpoint: blockingMetadataServer(t)}
+
+	start := time.Now()
+	_, err := NewSigV4RoundTripper(cfg, nil, WithLazyCredentials())
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// The configuration is still validated on construction.
+	_, err = NewSigV4RoundTripper(&SigV4Config{Region: "us-east-2", AccessKey: "test-id"}, nil, WithLazyCredentials())
+	require.ErrorContains(t, err, "must provide a AWS SigV4 Access key and Secret Key")
+}
+
+func TestSigV4RoundTripper_MaxSignedHeaders(t *testing.T) {
+	var called bool
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			called = true
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		maxSignedHeaders: 10,
+		creds:            credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func(headers int) error {
+		called = false
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		for i := 0; i < headers; i++ {
+			req.Header.Set(fmt.Sprintf("X-Header-%d", i), "value")
+		}
+		// Headers that aren't signed don't count.
+		req.Header.Set("User-Agent", "test")
+		_, err = rt.RoundTrip(req)
+		return err
+	}
+
+	require.NoError(t, roundTrip(9))
+	require.True(t, called)
+
+	require.ErrorContains(t, roundTrip(1000), "request has 1001 headers to sign, more than the maximum of 10")
+	require.False(t, called)
+}
+
+func TestSigV4RoundTripper_BedrockStreaming(t *testing.T) {
+	const body = `{"prompt":"Hello","max_tokens_to_sample":100}`
+
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { pw.Close() })
+
+	var gotReq *http.Request
+	var gotBody []byte
+	signTime := time.Now()
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "bedrock-runtime",
+		timeNow: func() time.Time { return signTime },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			var err error
+			gotBody, err = io.ReadAll(req.Body)
+			require.NoError(t, err)
+			return &http.Response{StatusCode: http.StatusOK, Body: pr}, nil
+		}),
+		defaultContentType: true,
+		creds:              credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	const url = "https://bedrock-runtime.us-east-2.amazonaws.com/model/anthropic.claude-v2:1/invoke-with-response-stream"
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	// The streamed response is handed to the caller as is.
+	require.Same(t, pr, resp.Body)
+	require.Equal(t, body, string(gotBody))
+	require.Equal(t, "application/json", gotReq.Header.Get("Content-Type"))
+
+	want, err := http.NewRequest(http.MethodPost, url, nil)
+	require.NoError(t, err)
+	want.Header.Set("Content-Type", "application/json")
+	var s v4Signer
+	_, err = s.sign(want, hashSHA256([]byte(body)), credentials.Value{AccessKeyID: "test-id", SecretAccessKey: "secret"}, "bedrock-runtime", "us-east-2", signTime)
+	require.NoError(t, err)
+	require.Equal(t, want.Header.Get("Authorization"), gotReq.Header.Get("Authorization"))
+}
+
+func TestNewSigV4RoundTripper_ClearEnvAfterLoad(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "env-token")
+
+	var gotReq *http.Request
+	rt, err := NewSigV4RoundTripper(&SigV4Config{Region: "us-east-2", ClearEnvAfterLoad: true}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		_, ok := os.LookupEnv(name)
+		require.False(t, ok, name)
+	}
+
+	// The credentials loaded from the environment are still used, rather
+	// than those of the shared credentials file, including after they were
+	// expired and by another round tripper with the same config.
+	credsFile := filepath.Join(t.TempDir(), "credentials")
+	require.NoError(t, os.WriteFile(credsFile, []byte("[default]\naws_access_key_id = file-id\naws_secret_access_key = file-secret\n"), 0o600))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credsFile)
+	rt2, err := NewSigV4RoundTripper(&SigV4Config{Region: "us-east-2", ClearEnvAfterLoad: true}, rt.(*sigV4RoundTripper).next)
+	require.NoError(t, err)
+	for _, rt := range []http.RoundTripper{rt, rt2} {
+		rt.(*sigV4RoundTripper).creds.Expire()
+		req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Contains(t, gotReq.Header.Get("Authorization"), "Credential=env-id/")
+		require.Equal(t, "env-token", gotReq.Header.Get("X-Amz-Security-Token"))
+	}
+}
+
+func TestSigV4RoundTripper_Nonce(t *testing.T) {
+	var nonces []string
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			nonces = append(nonces, req.Header.Get("X-Amz-Nonce"))
+			require.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-nonce,")
+			if len(nonces) == 2 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		newNonce:            randomNonce,
+		networkErrorRetries: 1,
+		creds:               credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	// The second request was retried after a network error.
+	require.Len(t, nonces, 3)
+	for _, nonce := range nonces {
+		require.Len(t, nonce, 32)
+	}
+	require.NotEqual(t, nonces[0], nonces[1])
+	require.NotEqual(t, nonces[1], nonces[2])
+}
+
+func TestSigV4RoundTripper_UserAgent(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	for _, tc := range []struct {
+		name          string
+		userAgent     string
+		signUserAgent bool
+		want          string
+	}{
+		{name: "Unset", want: "caller/1.0"},
+		{name: "Set", userAgent: "prometheus/2.0", want: "prometheus/2.0"},
+		{name: "Signed", userAgent: "prometheus/2.0", signUserAgent: true, want: "prometheus/2.0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotReq *http.Request
+			rt, err := NewSigV4RoundTripper(&SigV4Config{
+				Region:        "us-east-2",
+				AccessKey:     "test-id",
+				SecretKey:     "secret",
+				UserAgent:     tc.userAgent,
+				SignUserAgent: tc.signUserAgent,
+			}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				gotReq = req
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}))
+			require.NoError(t, err)
+
+			req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+			require.NoError(t, err)
+			req.Header.Set("User-Agent", "caller/1.0")
+			_, err = rt.RoundTrip(req)
+			require.NoError(t, err)
+
+			require.Equal(t, tc.want, gotReq.Header.Get("User-Agent"))
+			if tc.signUserAgent {
+				require.Contains(t, gotReq.Header.Get("Authorization"), "SignedHeaders=host;user-agent;x-amz-date,")
+			}
+		})
+	}
+}
+
+func TestNewSigV4RoundTripper_NonceGenerator(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var gotReq *http.Request
+	next := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	cfg := &SigV4Config{Region: "us-east-2", AccessKey: "test-id", SecretKey: "secret", AddNonceHeader: true}
+	rt, err := NewSigV4RoundTripper(cfg, next, WithNonceGenerator(func() (string, error) { return "nonce", nil }))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, "nonce", gotReq.Header.Get("X-Amz-Nonce"))
+
+	// Without add_nonce_header, the generator isn't used.
+	cfg.AddNonceHeader = false
+	rt, err = NewSigV4RoundTripper(cfg, next, WithNonceGenerator(func() (string, error) { return "nonce", nil }))
+	require.NoError(t, err)
+	req, err = http.NewRequest(http.MethodGet, "https://example.com", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Empty(t, gotReq.Header.Get("X-Amz-Nonce"))
+}
+
+func TestNewSigV4RoundTripper_Endpoint(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_REGION", "")
+
+	var gotReq *http.Request
+	next := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	for _, tc := range []struct {
+		cfg  SigV4Config
+		want string
+	}{
+		{cfg: SigV4Config{Endpoint: "https://search-domain.eu-west-1.es.amazonaws.com"}, want: "/eu-west-1/es/aws4_request"},
+		// Explicit settings take precedence.
+		{cfg: SigV4Config{Endpoint: "https://search-domain.eu-west-1.es.amazonaws.com", Region: "us-east-2"}, want: "/us-east-2/es/aws4_request"},
+		{cfg: SigV4Config{Endpoint: "https://search-domain.eu-west-1.es.amazonaws.com", Service: "aoss"}, want: "/eu-west-1/aoss/aws4_request"},
+		// Non-AWS hostnames leave region and service to their defaults.
+		{cfg: SigV4Config{Endpoint: "https://prometheus.example.com", Region: "us-east-2"}, want: "/us-east-2/aps/aws4_request"},
+	} {
+		cfg := tc.cfg
+		cfg.AccessKey, cfg.SecretKey = "test-id", "secret"
+		rt, err := NewSigV4RoundTripper(&cfg, next)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Contains(t, gotReq.Header.Get("Authorization"), tc.want, cfg.Endpoint)
+	}
+
+	_, err := NewSigV4RoundTripper(&SigV4Config{Endpoint: "https://prometheus.example.com", AccessKey: "test-id", SecretKey: "secret"}, next)
+	require.ErrorContains(t, err, "could not determine AWS region")
+
+	_, err = NewSigV4RoundTripper(&SigV4Config{Endpoint: "/api/v1/write", Region: "us-east-2"}, next)
+	require.ErrorContains(t, err, "endpoint must be an absolute URL")
+}
+
+func TestNewSigV4RoundTripper_Service(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var gotReq *http.Request
+	next := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	for service, want := range map[string]string{
+		// The service defaults to aps for backward compatibility.
+		"":            "/us-east-2/aps/aws4_request",
+		"aps":         "/us-east-2/aps/aws4_request",
+		"es":          "/us-east-2/es/aws4_request",
+		"execute-api": "/us-east-2/execute-api/aws4_request",
+		"timestream":  "/us-east-2/timestream/aws4_request",
+	} {
+		rt, err := NewSigV4RoundTripper(&SigV4Config{Region: "us-east-2", Service: service, AccessKey: "test-id", SecretKey: "secret"}, next)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Contains(t, gotReq.Header.Get("Authorization"), want, service)
+	}
+}
+
+func TestSigV4RoundTripper_RequireTLS(t *testing.T) {
+	redirect := &trackingBody{Reader: strings.NewReader("")}
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			location := "http://example.com" + req.URL.Path
+			if req.URL.Path == "/safe" {
+				location = "https://other.example.com/"
+			}
+			return &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     http.Header{"Location": []string{location}},
+				Body:       redirect,
+				Request:    req,
+			}, nil
+		}),
+		requireTLS: true,
+		creds:      credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/downgrade", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.ErrorContains(t, err, "refusing redirect from https to http://example.com/downgrade")
+	require.True(t, redirect.closed)
+
+	req, err = http.NewRequest(http.MethodGet, "https://example.com/safe", nil)
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	// Following the redirect with a client fails too.
+	req, err = http.NewRequest(http.MethodGet, "http://example.com/downgrade", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.ErrorContains(t, err, "refusing to sign request over http")
+
+	// Without require_tls, the redirect is returned as is.
+	rt.requireTLS = false
+	req, err = http.NewRequest(http.MethodGet, "https://example.com/downgrade", nil)
+	require.NoError(t, err)
+	resp, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestSigV4RoundTripper_MaxRetryDuration(t *testing.T) {
+	now := time.Now()
+	connReset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+	var calls int
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: func() time.Time { return now },
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			// Every attempt takes 10 seconds to fail.
+			now = now.Add(10 * time.Second)
+			if calls%2 == 0 {
+				return &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"0"}}, Body: http.NoBody}, nil
+			}
+			return nil, connReset
+		}),
+		networkErrorRetries: 10,
+		throttlingRetries:   10,
+		maxRetryDuration:    25 * time.Second,
+		creds:               credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 3, calls)
+
+	// The last response is returned once the budget is exceeded.
+	calls = 1
+	req, err = http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, 4, calls)
+}
+
+// lenBody is a request body that reports its remaining length.
+type lenBody struct {
+	r *bytes.Reader
+}
+
+func (b lenBody) Read(p []byte) (int, error) { return b.r.Read(p) }
+func (b lenBody) Len() int                   { return b.r.Len() }
+func (b lenBody) Close() error               { return nil }
+
+func TestSigV4RoundTripper_LenBody(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello, world!"), 10000)
+
+	prepare := func(body io.ReadCloser) (*http.Request, preparedRequest) {
+		rt := &sigV4RoundTripper{region: "us-east-2", service: "aps"}
+		rt.pool.New = rt.newBuf
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", nil)
+		require.NoError(t, err)
+		req.Body = body
+		p, release, err := rt.prepare(req, false)
+		require.NoError(t, err)
+		release()
+		return req, p
+	}
+
+	req, p := prepare(lenBody{bytes.NewReader(data)})
+	require.Equal(t, int64(len(data)), req.ContentLength)
+	require.Equal(t, hashSHA256(data), p.payloadHash)
+
+	lenAllocs := testing.AllocsPerRun(10, func() { prepare(lenBody{bytes.NewReader(data)}) })
+	plainAllocs := testing.AllocsPerRun(10, func() { prepare(io.NopCloser(struct{ io.Reader }{bytes.NewReader(data)})) })
+	require.Less(t, lenAllocs, plainAllocs)
+}
+
+func TestSigV4RoundTripper_BodyBufferedOnce(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello, world!"), 100000)
+
+	var sent io.Reader
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent = req.Body
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		creds: credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+	req, err := http.NewRequest(http.MethodPost, "https://example.com", nil)
+	require.NoError(t, err)
+	req.Body = lenBody{bytes.NewReader(data)}
+
+	// The body is held once, by the request, rather than in a buffer of the
+	// pool and in a copy for GetBody.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = rt.RoundTrip(req)
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(len(data))*3/2)
+	got, err := io.ReadAll(sent)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestNewSigV4RoundTripper_Anonymous(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var gotReq *http.Request
+	rt, err := NewSigV4RoundTripper(&SigV4Config{Anonymous: true}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://bucket.s3.amazonaws.com/public", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Empty(t, gotReq.Header.Get("Authorization"))
+	require.Empty(t, gotReq.Header.Get("X-Amz-Date"))
+}
+
+func TestSigV4RoundTripper_SoftBodySizeWarn(t *testing.T) {
+	var buf bytes.Buffer
+	var calls int
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		softBodySizeWarn: 10,
+		logger:           slog.New(slog.NewTextHandler(&buf, nil)),
+		creds:            credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	roundTrip := func(body string) {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	roundTrip("Hello!")
+	require.Empty(t, buf.String())
+
+	roundTrip("Hello, world!")
+	require.Contains(t, buf.String(), `level=WARN msg="Request body exceeds soft_body_size_warn" size=13 soft_body_size_warn=10`)
+	require.Equal(t, 2, calls)
+}
+
+func TestSigV4RoundTripper_RequireContentLength(t *testing.T) {
+	var calls int
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		requireContentLength: true,
+		creds:                credentials.NewStaticCredentials("test-id", "secret", ""),
+	}
+	rt.pool.New = rt.newBuf
+
+	// A body of unknown length, which is sent chunked.
+	chunked := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com", io.NopCloser(strings.NewReader("Hello, world!")))
+		require.NoError(t, err)
+		require.Zero(t, req.ContentLength)
+		return req
+	}
+	_, err := rt.RoundTrip(chunked())
+	require.ErrorContains(t, err, "request body of unknown length would have to be buffered to be signed")
+	require.Zero(t, calls)
+
+	// Bodies of known length are signed as usual.
+	req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+
+	// Bodies that aren't hashed don't have to be buffered.
+	rt.unsignedPayload = true
+	_, err = rt.RoundTrip(chunked())
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+}
+
+func TestNewSigV4RoundTripperContext(t *testing.T) {
+	// Credentials that never resolve, like from an unreachable instance
+	// metadata service.
+	cfg := &SigV4Config{Region: "us-east-2", EC2MetadataEndpoint: blockingMetadataServer(t)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := NewSigV4RoundTripperContext(ctx, cfg, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestNewSigV4RoundTripper_NoRegion(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_SDK_LOAD_CONFIG", "1")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+
+	_, err := NewSigV4RoundTripper(&SigV4Config{AccessKey: "test-id", SecretKey: "secret"}, nil)
+	require.EqualError(t, err, "could not determine AWS region: set region in the sigv4 config or AWS_REGION")
+}
+
+func TestSigV4RoundTripper_CredentialsRespectRequestContext(t *testing.T) {
+	provider := &blockingProvider{release: make(chan struct{})}
+	t.Cleanup(func() { close(provider.release) })
+
+	var called bool
+	rt := &sigV4RoundTripper{
+		region:  "us-east-2",
+		service: "aps",
+		timeNow: time.Now,
+		next: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			called = true
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+		credentialsErrorCooldown: time.Minute,
+		creds:                    credentials.NewCredentials(provider),
+	}
+	rt.pool.New = rt.newBuf
+
+	for _, tc := range []struct {
+		name    string
+		ctx     func() (context.Context, context.CancelFunc)
+		wantErr error
+	}{
+		{
+			name: "Canceled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(10*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			wantErr: context.Canceled,
+		},
+		{
+			name: "Deadline",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 10*time.Millisecond)
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := tc.ctx()
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+			require.NoError(t, err)
+
+			start := time.Now()
+			_, err = rt.RoundTrip(req)
+			require.ErrorIs(t, err, tc.wantErr)
+			require.Less(t, time.Since(start), 5*time.Second)
+			require.False(t, called)
+		})
+	}
+
+	// Giving up on credentials doesn't count as failing to retrieve them.
+	require.NoError(t, rt.credsErr)
+}
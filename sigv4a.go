@@ -0,0 +1,165 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const (
+	// asymmetricSigningAlgorithm is the algorithm of SigV4A signatures, which
+	// are valid in a set of regions rather than a single one.
+	asymmetricSigningAlgorithm = "AWS4-ECDSA-P256-SHA256"
+
+	// SigningAlgorithmSigV4 and SigningAlgorithmSigV4A are the values of the
+	// signing_algorithm setting.
+	SigningAlgorithmSigV4  = "sigv4"
+	SigningAlgorithmSigV4A = "sigv4a"
+)
+
+// asymmetricSigningScope returns the credential scope of SigV4A signatures
+// made at signTime, which unlike SigV4 doesn't include a region.
+func asymmetricSigningScope(service string, signTime time.Time) string {
+	return strings.Join([]string{signTime.UTC().Format(shortDateFormat), service, scopeTerminator}, "/")
+}
+
+// asymmetricSignature returns the hex encoded SigV4A signature of req, given
+// its canonical headers block and signed header names. ECDSA signatures are
+// randomized, so unlike SigV4 signing the same request twice gives different
+// signatures.
+func (s *v4Signer) asymmetricSignature(req *http.Request, canonicalHeaders, signedHeaders, payloadHash string, creds credentials.Value, service string, signTime time.Time) (string, error) {
+	stringToSign := strings.Join([]string{
+		asymmetricSigningAlgorithm,
+		signTime.UTC().Format(amzDateFormat),
+		asymmetricSigningScope(service, signTime),
+		s.hash([]byte(s.canonicalRequest(req, canonicalHeaders, signedHeaders, payloadHash))),
+	}, "\n")
+
+	key, err := asymmetricKey(creds.AccessKeyID, creds.SecretAccessKey)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(stringToSign))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sig), nil
+}
+
+// maxAsymmetricKeys bounds the number of derived SigV4A keys that are cached,
+// as temporary credentials are rotated for the life of the process.
+const maxAsymmetricKeys = 64
+
+type asymmetricKeyID struct {
+	accessKeyID, secretAccessKey string
+}
+
+var (
+	asymmetricKeysMtx sync.Mutex
+	asymmetricKeys    = map[asymmetricKeyID]*ecdsa.PrivateKey{}
+)
+
+// asymmetricKey returns the SigV4A key of an access key pair, which is only
+// derived the first time, as deriving it takes a few HMACs and a scalar
+// multiplication.
+func asymmetricKey(accessKeyID, secretAccessKey string) (*ecdsa.PrivateKey, error) {
+	id := asymmetricKeyID{accessKeyID: accessKeyID, secretAccessKey: secretAccessKey}
+	asymmetricKeysMtx.Lock()
+	key, ok := asymmetricKeys[id]
+	asymmetricKeysMtx.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	key, err := deriveAsymmetricKey(accessKeyID, secretAccessKey)
+	if err != nil {
+		return nil, err
+	}
+	asymmetricKeysMtx.Lock()
+	defer asymmetricKeysMtx.Unlock()
+	if len(asymmetricKeys) >= maxAsymmetricKeys {
+		clear(asymmetricKeys)
+	}
+	asymmetricKeys[id] = key
+	return key, nil
+}
+
+// deriveAsymmetricKey derives the P-256 key pair SigV4A signatures are made
+// with from an access key pair. The private key is derived with the NIST SP
+// 800-108 KDF in counter mode, trying candidates until one is in the range of
+// valid keys.
+func deriveAsymmetricKey(accessKeyID, secretAccessKey string) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	params := curve.Params()
+	nMinusTwo := new(big.Int).Sub(params.N, big.NewInt(2))
+	inputKey := []byte("AWS4A" + secretAccessKey)
+
+	for counter := 1; counter <= 0xff; counter++ {
+		context := append([]byte(accessKeyID), byte(counter))
+		candidate := new(big.Int).SetBytes(hmacKeyDerivation(inputKey, params.BitSize, []byte(asymmetricSigningAlgorithm), context))
+		if candidate.Cmp(nMinusTwo) > 0 {
+			continue
+		}
+
+		d := candidate.Add(candidate, big.NewInt(1))
+		priv, err := ecdh.P256().NewPrivateKey(d.FillBytes(make([]byte, 32)))
+		if err != nil {
+			return nil, err
+		}
+		// The public key is encoded uncompressed, as 0x04 || X || Y.
+		pub := priv.PublicKey().Bytes()
+		key := &ecdsa.PrivateKey{D: d}
+		key.Curve = curve
+		key.X = new(big.Int).SetBytes(pub[1:33])
+		key.Y = new(big.Int).SetBytes(pub[33:])
+		return key, nil
+	}
+	return nil, fmt.Errorf("could not derive a SigV4A key for access key %s", accessKeyID)
+}
+
+// hmacKeyDerivation derives a key of bitLen bits from key with HMAC-SHA256 in
+// counter mode, as specified by NIST SP 800-108.
+func hmacKeyDerivation(key []byte, bitLen int, label, context []byte) []byte {
+	fixedInput := make([]byte, 0, len(label)+1+len(context)+4)
+	fixedInput = append(fixedInput, label...)
+	fixedInput = append(fixedInput, 0)
+	fixedInput = append(fixedInput, context...)
+	fixedInput = binary.BigEndian.AppendUint32(fixedInput, uint32(bitLen))
+
+	var out []byte
+	h := hmac.New(sha256.New, key)
+	for i := uint32(1); len(out) < bitLen/8; i++ {
+		h.Reset()
+		_ = binary.Write(h, binary.BigEndian, i)
+		h.Write(fixedInput)
+		out = h.Sum(out)
+	}
+	return out[:bitLen/8]
+}
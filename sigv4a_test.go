@@ -0,0 +1,139 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sigv4
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDeriveAsymmetricKey checks the derived key pair against the test vector
+// of the AWS SDK.
+func TestDeriveAsymmetricKey(t *testing.T) {
+	key, err := deriveAsymmetricKey("AKISORANDOMAASORANDOM", "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom")
+	require.NoError(t, err)
+	require.Equal(t, "15D242CEEBF8D8169FD6A8B5A746C41140414C3B07579038DA06AF89190FFFCB", fmt.Sprintf("%064X", key.X))
+	require.Equal(t, "0515242CEDD82E94799482E4C0514B505AFCCF2C0C98D6A553BF539F424C5EC0", fmt.Sprintf("%064X", key.Y))
+}
+
+func TestAsymmetricKey(t *testing.T) {
+	key, err := asymmetricKey("test-id", "secret")
+	require.NoError(t, err)
+	cached, err := asymmetricKey("test-id", "secret")
+	require.NoError(t, err)
+	require.Same(t, key, cached)
+
+	// Rotated secrets get their own key.
+	other, err := asymmetricKey("test-id", "rotated")
+	require.NoError(t, err)
+	require.NotEqual(t, key.D, other.D)
+}
+
+func TestV4Signer_Asymmetric(t *testing.T) {
+	creds := credentials.Value{AccessKeyID: "test-id", SecretAccessKey: "secret"}
+	for _, tc := range []struct {
+		name      string
+		regionSet []string
+		want      string
+	}{
+		{name: "Signing region", want: "us-east-2"},
+		{name: "Region set", regionSet: []string{"us-east-1", "us-west-2"}, want: "us-east-1,us-west-2"},
+		{name: "All regions", regionSet: []string{"*"}, want: "*"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "https://example.com/api/v1/write", nil)
+			require.NoError(t, err)
+			s := v4Signer{asymmetric: true, regionSet: tc.regionSet}
+			_, err = s.sign(req, hashSHA256(nil), creds, "aps", "us-east-2", testSignTime)
+			require.NoError(t, err)
+
+			require.Equal(t, tc.want, req.Header.Get("X-Amz-Region-Set"))
+			auth := req.Header.Get("Authorization")
+			prefix := "AWS4-ECDSA-P256-SHA256 Credential=test-id/20210601/aps/aws4_request, SignedHeaders=host;x-amz-date;x-amz-region-set, Signature="
+			require.True(t, strings.HasPrefix(auth, prefix), auth)
+
+			// The signature is randomized, so verify it with the public key
+			// rather than comparing it.
+			sig, err := hex.DecodeString(strings.TrimPrefix(auth, prefix))
+			require.NoError(t, err)
+			canonicalRequest := strings.Join([]string{
+				http.MethodPost,
+				"/api/v1/write",
+				"",
+				"host:example.com\nx-amz-date:20210601T102030Z\nx-amz-region-set:" + tc.want + "\n",
+				"host;x-amz-date;x-amz-region-set",
+				hashSHA256(nil),
+			}, "\n")
+			stringToSign := "AWS4-ECDSA-P256-SHA256\n20210601T102030Z\n20210601/aps/aws4_request\n" + hashSHA256([]byte(canonicalRequest))
+			digest := sha256.Sum256([]byte(stringToSign))
+			key, err := deriveAsymmetricKey(creds.AccessKeyID, creds.SecretAccessKey)
+			require.NoError(t, err)
+			require.True(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig))
+		})
+	}
+}
+
+func TestNewSigV4RoundTripper_SigningAlgorithm(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	for _, tc := range []struct {
+		algorithm string
+		want      string
+	}{
+		{algorithm: "", want: "AWS4-HMAC-SHA256 Credential=test-id/"},
+		{algorithm: SigningAlgorithmSigV4, want: "AWS4-HMAC-SHA256 Credential=test-id/"},
+		{algorithm: SigningAlgorithmSigV4A, want: "AWS4-ECDSA-P256-SHA256 Credential=test-id/"},
+	} {
+		t.Run(tc.algorithm, func(t *testing.T) {
+			var gotReq *http.Request
+			rt, err := NewSigV4RoundTripper(&SigV4Config{
+				Region:           "us-east-2",
+				AccessKey:        "test-id",
+				SecretKey:        "secret",
+				SigningAlgorithm: tc.algorithm,
+			}, RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				gotReq = req
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			}))
+			require.NoError(t, err)
+
+			req, err := http.NewRequest(http.MethodPost, "https://example.com", strings.NewReader("Hello, world!"))
+			require.NoError(t, err)
+			_, err = rt.RoundTrip(req)
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(gotReq.Header.Get("Authorization"), tc.want), gotReq.Header.Get("Authorization"))
+		})
+	}
+
+	t.Run("Presign", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+		require.NoError(t, err)
+		_, err = Presign(req.Context(), &SigV4Config{
+			Region:           "us-east-2",
+			AccessKey:        "test-id",
+			SecretKey:        "secret",
+			SigningAlgorithm: SigningAlgorithmSigV4A,
+		}, req, time.Minute)
+		require.ErrorContains(t, err, "not supported")
+	})
+}
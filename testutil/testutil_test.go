@@ -0,0 +1,63 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func TestNewTestRoundTripper(t *testing.T) {
+	var gotReq *http.Request
+	rt := NewTestRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com/api/v1/remote_write", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	require.Contains(t, gotReq.Header.Get("Authorization"), "Credential="+AccessKey+"/")
+	require.Contains(t, gotReq.Header.Get("Authorization"), "/"+Region+"/aps/aws4_request")
+}
+
+func TestFakeCredentialsProvider(t *testing.T) {
+	provider := &FakeCredentialsProvider{}
+	creds := credentials.NewCredentials(provider)
+
+	v, err := creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, AccessKey, v.AccessKeyID)
+	require.Equal(t, SecretKey, v.SecretAccessKey)
+
+	_, err = creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, 1, provider.Retrieved)
+
+	provider.Expired = true
+	_, err = creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, 2, provider.Retrieved)
+}